@@ -2,16 +2,29 @@ package seg
 
 import "iter"
 
-var validFDCaps = []int{63, 47, 31, 23, 19, 15, 11, 7, 6, 5, 4, 3, 2, 1}
+var validFDSizes = []int{64, 48, 32, 24, 20, 16, 12, 8, 7, 6, 5, 4, 3, 2}
 
 // CANFDStrategy yields discrete ISO 11898-1 CAN FD frame sizes with 0% padding.
 func CANFDStrategy(segSize int) Strategy {
-	validCaps := validFDCaps
-	for i, v := range validCaps {
-		if v+1 <= segSize {
-			validCaps = validCaps[i:]
-			break
+	return canFDStrategy(segSize, classicHdrLen)
+}
+
+// CANFDStrategyExt is like CANFDStrategy, but takes the
+// two-byte header of the extended format into account.
+func CANFDStrategyExt(segSize int) Strategy {
+	return canFDStrategy(segSize, extHdrLen)
+}
+
+func canFDStrategy(segSize, hdrLen int) Strategy {
+	var validCaps []int
+	for _, size := range validFDSizes {
+		if size > segSize || size <= hdrLen {
+			continue
 		}
+		validCaps = append(validCaps, size-hdrLen)
+	}
+	if len(validCaps) == 0 {
+		validCaps = []int{1}
 	}
 	return func(msgLen int) (int, iter.Seq[int]) {
 
@@ -0,0 +1,88 @@
+package seg
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/knieriem/hash/crc16"
+)
+
+// WithCRC16 appends a CRC-16, as used by Modbus RTU, to each message
+// written, and verifies and strips it from each message read.
+// Both peers must use the same setting.
+func WithCRC16() Option {
+	tab := crc16.MakeTable(crc16.IBMCRC)
+	return func(s *Seg) {
+		s.checksum = &checksum{
+			size: 2,
+			sum: func(b []byte) uint32 {
+				return uint32(crc16.Checksum(b, tab))
+			},
+		}
+	}
+}
+
+// WithCRC32 is like WithCRC16, but uses the IEEE CRC-32.
+func WithCRC32() Option {
+	return func(s *Seg) {
+		s.checksum = &checksum{
+			size: 4,
+			sum:  crc32.ChecksumIEEE,
+		}
+	}
+}
+
+// ChecksumError is returned by ReadMsg if the checksum
+// appended to a message does not match its data.
+type ChecksumError struct {
+	Got  uint32 // checksum received, zero if the message was too short
+	Want uint32 // checksum calculated
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("seg: checksum mismatch: got %#x, want %#x", e.Got, e.Want)
+}
+
+// checksum describes a checksum that is transmitted
+// in little endian byte order following the message data.
+type checksum struct {
+	size int
+	sum  func([]byte) uint32
+}
+
+func (c *checksum) appendSum(dst, data []byte) []byte {
+	v := c.sum(data)
+	for range c.size {
+		dst = append(dst, byte(v))
+		v >>= 8
+	}
+	return dst
+}
+
+// checkMsg verifies and strips the checksum of a message
+// that has been appended to dst[:off], if checksums are enabled.
+func (s *Seg) checkMsg(dst []byte, off int) ([]byte, error) {
+	c := s.checksum
+	if c == nil {
+		s.endMsg()
+		return dst, nil
+	}
+	msg := dst[off:]
+	n := len(msg) - c.size
+	if n < 0 {
+		err := &ChecksumError{Want: c.sum(msg)}
+		s.recvError(err)
+		return dst[:off], err
+	}
+	var got uint32
+	for i := c.size - 1; i >= 0; i-- {
+		got = got<<8 | uint32(msg[n+i])
+	}
+	if want := c.sum(msg[:n]); got != want {
+		err := &ChecksumError{Got: got, Want: want}
+		s.recvError(err)
+		return dst[:off], err
+	}
+	s.endMsg()
+	return dst[:off+n], nil
+}
@@ -8,11 +8,13 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"sync/atomic"
 	"time"
 
 	"github.com/knieriem/hash/crc16"
 	"github.com/knieriem/modbus"
 	"github.com/knieriem/seg"
+	"github.com/knieriem/seg/slip"
 	"github.com/knieriem/serframe"
 )
 
@@ -27,10 +29,11 @@ var (
 
 	crctab = crc16.MakeTable(crc16.IBMCRC)
 
-	canDev = flag.String("can", "", "use the specified can device")
+	canDev  = flag.String("can", "", "use the specified can device")
+	useSLIP = flag.Bool("slip", false, "use SLIP framing on stdin/stdout")
 )
 
-var fakeMultiAcks bool
+var fakeMultiAcks atomic.Bool
 
 func main() {
 	var c io.ReadWriter
@@ -49,6 +52,9 @@ func main() {
 		}
 	} else {
 		c = &conn{os.Stdin, os.Stdout}
+		if *useSLIP {
+			c = slip.New(c)
+		}
 	}
 
 	tm := seg.New(c, *frameSize, "can")
@@ -77,12 +83,12 @@ func main() {
 				log.Fatal(err)
 			}
 			_, err = tm.Write(data[:len(data)-2])
-			if fakeMultiAcks {
+			if fakeMultiAcks.Load() {
 				for range 3 {
 					time.Sleep(50 * time.Millisecond)
 					_, err = tm.Write(data[:len(data)-2])
 				}
-				fakeMultiAcks = false
+				fakeMultiAcks.Store(false)
 			}
 			if err != nil {
 				log.Fatal(err)
@@ -99,7 +105,7 @@ func main() {
 		buf = append(buf, byte(crc&0xFF), byte((crc>>8)&0xFF))
 		if buf[2] == cmdGwCatch {
 			if *fakeMultipleAcks {
-				fakeMultiAcks = true
+				fakeMultiAcks.Store(true)
 			}
 		}
 		_, err = f.Write(buf)
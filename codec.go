@@ -0,0 +1,182 @@
+package seg
+
+// FrameKind classifies frames according to their header.
+type FrameKind int
+
+const (
+	SingleFrame  FrameKind = iota // message consisting of a single frame
+	StartFrame                    // first frame of a multi-frame message
+	ContFrame                     // continuation frame
+	ControlFrame                  // flow control frame or acknowledgement
+)
+
+// Header contains the information carried by the header of a frame.
+// A header format need not represent all fields; those it does not
+// represent are ignored by PutHeader, and zero after ParseHeader.
+type Header struct {
+	Kind FrameKind
+
+	// Index is the position of a continuation frame within its message.
+	// Header formats with wrapping sequence numbers decode it modulo
+	// the value returned by Codec.IndexMod.
+	Index int
+
+	// Count and Len describe the message started by a single or start
+	// frame: the number of frames, and the length in bytes. Each
+	// header format must announce at least one of them.
+	Count int
+	Len   int
+
+	// Tag identifies the message a frame belongs to. Seg assigns
+	// consecutive tags to the messages it writes, and aborts reassembly
+	// if a continuation frame carries a tag different from the start frame.
+	Tag int
+
+	// Status is the flow status of a flow control frame,
+	// or identifies the kind of another control frame.
+	Status byte
+}
+
+// Codec encodes and decodes the header at the beginning of each frame.
+// ClassicCodec is the default.
+type Codec interface {
+	// HeaderLen returns the length of header h in bytes. It may depend
+	// on the kind of the frame, and on the message length, but not on
+	// the frame count.
+	HeaderLen(h Header) int
+
+	// MaxFrames returns the maximum number of frames per message
+	// the header format is able to represent, or zero, if not limited.
+	MaxFrames() int
+
+	// IndexMod returns the number of distinct continuation indexes,
+	// if they wrap around, or zero.
+	IndexMod() int
+
+	// PutHeader encodes h into the first HeaderLen(h) bytes of b,
+	// and returns its length.
+	PutHeader(b []byte, h Header) int
+
+	// ParseHeader decodes the header at the beginning of b, and returns
+	// its length. If b is too short, or the header is invalid, ok is false.
+	ParseHeader(b []byte) (h Header, n int, ok bool)
+}
+
+const startBit byte = 1 << 7
+
+// Header lengths of the classic and the extended format.
+const (
+	classicHdrLen = 1
+	extHdrLen     = 2
+)
+
+// ClassicCodec implements the classic header format: a single byte,
+// containing a start bit, followed by the number of continuation frames
+// of a message, or the continuation index. Continuation index zero
+// identifies control frames, the status of which follows in the next byte.
+// Messages may consist of up to 128 frames.
+type ClassicCodec struct{}
+
+func (ClassicCodec) HeaderLen(h Header) int { return classicHdrLen + statusLen(h) }
+func (ClassicCodec) MaxFrames() int         { return 1 << 7 }
+func (ClassicCodec) IndexMod() int          { return 0 }
+
+func (ClassicCodec) PutHeader(b []byte, h Header) int {
+	start, v := headerValue(h)
+	b[0] = byte(v)
+	if start {
+		b[0] |= startBit
+	}
+	return putStatus(b, classicHdrLen, h)
+}
+
+func (ClassicCodec) ParseHeader(b []byte) (h Header, n int, ok bool) {
+	if len(b) < classicHdrLen {
+		return h, 0, false
+	}
+	h = parseHeaderValue(b[0]&startBit != 0, int(b[0]&^startBit))
+	return parseStatus(b, classicHdrLen, h)
+}
+
+// ExtendedCodec implements the extended header format, which uses
+// two bytes: the start bit, followed by a 15-bit value with the same
+// meaning as in the classic format. Messages may consist of up to
+// 32768 frames.
+type ExtendedCodec struct{}
+
+func (ExtendedCodec) HeaderLen(h Header) int { return extHdrLen + statusLen(h) }
+func (ExtendedCodec) MaxFrames() int         { return 1 << 15 }
+func (ExtendedCodec) IndexMod() int          { return 0 }
+
+func (ExtendedCodec) PutHeader(b []byte, h Header) int {
+	start, v := headerValue(h)
+	b[0] = byte(v >> 8)
+	b[1] = byte(v)
+	if start {
+		b[0] |= startBit
+	}
+	return putStatus(b, extHdrLen, h)
+}
+
+func (ExtendedCodec) ParseHeader(b []byte) (h Header, n int, ok bool) {
+	if len(b) < extHdrLen {
+		return h, 0, false
+	}
+	v := int(b[0]&^startBit)<<8 | int(b[1])
+	h = parseHeaderValue(b[0]&startBit != 0, v)
+	return parseStatus(b, extHdrLen, h)
+}
+
+// headerValue returns the start bit and the value that
+// represent header h in the classic and extended formats.
+func headerValue(h Header) (start bool, v int) {
+	switch h.Kind {
+	case SingleFrame:
+		return true, 0
+	case StartFrame:
+		return true, h.Count - 1
+	case ContFrame:
+		return false, h.Index
+	}
+	return false, 0
+}
+
+func parseHeaderValue(start bool, v int) Header {
+	switch {
+	case start && v == 0:
+		return Header{Kind: SingleFrame, Count: 1}
+	case start:
+		return Header{Kind: StartFrame, Count: v + 1}
+	case v == 0:
+		return Header{Kind: ControlFrame}
+	}
+	return Header{Kind: ContFrame, Index: v}
+}
+
+// statusLen returns the length of the status byte following
+// the header value of control frames.
+func statusLen(h Header) int {
+	if h.Kind == ControlFrame {
+		return 1
+	}
+	return 0
+}
+
+func putStatus(b []byte, n int, h Header) int {
+	if h.Kind == ControlFrame {
+		b[n] = h.Status
+		n++
+	}
+	return n
+}
+
+func parseStatus(b []byte, n int, h Header) (Header, int, bool) {
+	if h.Kind == ControlFrame {
+		if len(b) <= n {
+			return h, 0, false
+		}
+		h.Status = b[n]
+		n++
+	}
+	return h, n, true
+}
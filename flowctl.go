@@ -0,0 +1,228 @@
+package seg
+
+import (
+	"errors"
+	"time"
+)
+
+// FlowControl configures the flow control mode, which is modelled after
+// ISO 15765-2: the receiver answers a start frame with a flow control frame,
+// specifying the number of continuation frames the sender may transmit
+// before it has to wait for the next flow control frame, and the minimum
+// separation time between these frames. Both peers must enable flow control.
+type FlowControl struct {
+	// Receiver side: number of continuation frames per block;
+	// zero means that all remaining frames may be sent at once.
+	BlockSize int
+
+	// Receiver side: minimum separation time requested from the sender.
+	// It is transmitted with the resolution defined by ISO 15765-2,
+	// i.e. 100µs steps up to 900µs, and milliseconds up to 127ms.
+	SepTime time.Duration
+
+	// Sender side: maximum time to wait for a flow control frame;
+	// DefaultFlowControlTimeout, if zero.
+	Timeout time.Duration
+}
+
+var DefaultFlowControlTimeout = time.Second
+
+// maxFCWait is the maximum number of consecutive wait
+// frames a sender accepts from the receiver.
+const maxFCWait = 16
+
+// Errors returned by Write in flow control mode.
+var (
+	ErrFlowControlTimeout  = errors.New("seg: timeout waiting for flow control frame")
+	ErrFlowControlOverflow = errors.New("seg: receiver reported overflow")
+	ErrFlowControlWait     = errors.New("seg: too many flow control wait frames")
+	ErrFlowControlStatus   = errors.New("seg: invalid flow control status")
+)
+
+// WithFlowControl enables the flow control mode.
+//
+// Flow control frames are control frames of the header format;
+// in the seg formats, the start bit is cleared and the index is zero.
+// They are recognized by a goroutine that reads frames in the background,
+// and that is started by New; frames belonging to messages
+// should be consumed by calling ReadMsg, otherwise flow control
+// frames cannot be received anymore.
+func WithFlowControl(fc FlowControl) Option {
+	return func(s *Seg) {
+		if fc.Timeout == 0 {
+			fc.Timeout = DefaultFlowControlTimeout
+		}
+		s.fc = &flowControl{
+			FlowControl: fc,
+			c:           make(chan fcFrame, 1),
+		}
+	}
+}
+
+// flow status values, as in ISO 15765-2
+const (
+	fcContinue = iota
+	fcWait
+	fcOverflow
+)
+
+type fcFrame struct {
+	status    byte
+	blockSize int
+	sepTime   time.Duration
+}
+
+type flowControl struct {
+	FlowControl
+	c chan fcFrame // flow control frames received
+}
+
+// needFC reports whether the receiver must send a flow control frame
+// after frame iCont of a multi-frame message has been received.
+func (fc *flowControl) needFC(iCont int) bool {
+	return iCont == 0 || fc.BlockSize > 0 && iCont%fc.BlockSize == 0
+}
+
+// sendFC sends a flow control frame with the specified status.
+func (s *Seg) sendFC(status byte) error {
+	hdr := Header{Kind: ControlFrame, Status: status}
+	h := s.codec.HeaderLen(hdr)
+	b := make([]byte, h+2)
+	s.codec.PutHeader(b, hdr)
+	b[h] = byte(min(s.fc.BlockSize, 255))
+	b[h+1] = encodeSTmin(s.fc.SepTime)
+	s.trace("<-", "fc", b)
+	return s.writeFrame(b)
+}
+
+// notifyOverflow tells the sender, in flow control mode,
+// that the message being received has been rejected.
+func (s *Seg) notifyOverflow() error {
+	if s.fc == nil {
+		return nil
+	}
+	return s.sendFC(fcOverflow)
+}
+
+// dispatchFC checks whether frame b is a flow control frame,
+// and if it is, passes it on to the writer.
+func (s *Seg) dispatchFC(b []byte) bool {
+	hdr, h, ok := s.codec.ParseHeader(b)
+	if !ok || hdr.Kind != ControlFrame || len(b) < h+2 {
+		return false
+	}
+	s.trace("->", "fc", b)
+	f := fcFrame{
+		status:    hdr.Status,
+		blockSize: int(b[h]),
+		sepTime:   decodeSTmin(b[h+1]),
+	}
+	for {
+		select {
+		case s.fc.c <- f:
+			return true
+		default:
+			// replace a frame the writer has not consumed yet
+			s.discardFC()
+		}
+	}
+}
+
+// awaitFC waits until the receiver allows sending the next block
+// of continuation frames, and returns its block size, which is zero
+// if there is no limit, and the minimum separation time.
+func (s *Seg) awaitFC() (blockSize int, sepTime time.Duration, err error) {
+	timeout := s.fc.Timeout
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	nWait := 0
+	for {
+		select {
+		case f := <-s.fc.c:
+			switch f.status {
+			case fcContinue:
+				return f.blockSize, f.sepTime, nil
+			case fcWait:
+				nWait++
+				if nWait > maxFCWait {
+					return 0, 0, ErrFlowControlWait
+				}
+				t.Reset(timeout)
+			case fcOverflow:
+				return 0, 0, ErrFlowControlOverflow
+			default:
+				return 0, 0, ErrFlowControlStatus
+			}
+		case <-t.C:
+			return 0, 0, ErrFlowControlTimeout
+		}
+	}
+}
+
+// contPacer paces the continuation frames of a message,
+// honouring flow control, if enabled, and the write delay.
+type contPacer struct {
+	s        *Seg
+	nFrames  int
+	blockRem int // continuation frames left in the current block
+	sepTime  time.Duration
+}
+
+// wait must be called before each continuation frame is written.
+func (p *contPacer) wait() error {
+	s := p.s
+	if s.fc != nil {
+		if p.blockRem == 0 {
+			bs, st, err := s.awaitFC()
+			if err != nil {
+				return err
+			}
+			p.blockRem = bs
+			if bs == 0 {
+				p.blockRem = p.nFrames
+			}
+			p.sepTime = st
+		}
+		p.blockRem--
+	}
+	if d := max(s.WriteDelay(), p.sepTime); d != 0 {
+		time.Sleep(d)
+	}
+	return nil
+}
+
+// discardFC drops a flow control frame that may
+// have been left over from a previous transfer.
+func (s *Seg) discardFC() {
+	select {
+	case <-s.fc.c:
+	default:
+	}
+}
+
+func encodeSTmin(d time.Duration) byte {
+	switch {
+	case d <= 0:
+		return 0
+	case d <= 900*time.Microsecond:
+		// 0xF1 to 0xF9: 100 to 900 µs; longer durations
+		// are rounded up to whole milliseconds
+		n := (d + 100*time.Microsecond - 1) / (100 * time.Microsecond)
+		return 0xF0 + byte(n)
+	case d >= 127*time.Millisecond:
+		return 127
+	}
+	return byte((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func decodeSTmin(b byte) time.Duration {
+	switch {
+	case b <= 0x7F:
+		return time.Duration(b) * time.Millisecond
+	case b >= 0xF1 && b <= 0xF9:
+		return time.Duration(b-0xF0) * 100 * time.Microsecond
+	}
+	// reserved values are to be interpreted as the maximum
+	return 127 * time.Millisecond
+}
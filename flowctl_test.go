@@ -0,0 +1,47 @@
+package seg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSTmin(t *testing.T) {
+	const us = time.Microsecond
+	const ms = time.Millisecond
+
+	for _, tc := range []struct {
+		d    time.Duration
+		b    byte
+		back time.Duration
+	}{
+		{0, 0, 0},
+		{50 * us, 0xF1, 100 * us},
+		{100 * us, 0xF1, 100 * us},
+		{101 * us, 0xF2, 200 * us},
+		{900 * us, 0xF9, 900 * us},
+		{901 * us, 0x01, ms},
+		{950 * us, 0x01, ms},
+		{999 * us, 0x01, ms},
+		{ms, 0x01, ms},
+		{ms + us, 0x02, 2 * ms},
+		{126 * ms, 126, 126 * ms},
+		{126*ms + 500*us, 127, 127 * ms},
+		{127 * ms, 127, 127 * ms},
+		{time.Second, 127, 127 * ms},
+	} {
+		b := encodeSTmin(tc.d)
+		if b != tc.b {
+			t.Errorf("encode %v: got %#x, want %#x", tc.d, b, tc.b)
+		}
+		if d := decodeSTmin(b); d != tc.back {
+			t.Errorf("decode %#x: got %v, want %v", b, d, tc.back)
+		}
+	}
+
+	// reserved values
+	for _, b := range []byte{0x80, 0xF0, 0xFA, 0xFF} {
+		if d := decodeSTmin(b); d != 127*ms {
+			t.Errorf("decode %#x: got %v, want %v", b, d, 127*ms)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package seg
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// FrameInfo contains metadata of a frame received.
+type FrameInfo struct {
+	Time   time.Time // time of reception, as far as known
+	Source any       // source address, like a CAN identifier or a net.Addr
+}
+
+// FrameConn is a connection transferring discrete frames.
+type FrameConn interface {
+	// ReadFrame reads the next frame into b, and returns its length.
+	// If the frame does not fit into b, the part that fits is stored,
+	// and ErrFrameTruncated is returned.
+	ReadFrame(b []byte) (n int, info FrameInfo, err error)
+
+	// WriteFrame writes b as a single frame. If b exceeds
+	// the maximum frame size of the connection,
+	// ErrFrameTooLarge is returned.
+	WriteFrame(b []byte) error
+}
+
+var (
+	ErrFrameTruncated = errors.New("seg: frame truncated")
+	ErrFrameTooLarge  = errors.New("seg: frame too large")
+)
+
+// ReadWriterFrameConn adapts rw to the FrameConn interface. Each call of
+// rw's Read must return exactly one frame, and each call of Write must
+// write b as a single frame. Since truncation cannot be detected,
+// rw's Read should do so by returning ErrFrameTruncated.
+func ReadWriterFrameConn(rw io.ReadWriter) FrameConn {
+	if fc, ok := rw.(FrameConn); ok {
+		return fc
+	}
+	return &rwFrameConn{rw: rw}
+}
+
+type rwFrameConn struct {
+	rw io.ReadWriter
+}
+
+func (c *rwFrameConn) ReadFrame(b []byte) (int, FrameInfo, error) {
+	n, err := c.rw.Read(b)
+	return n, FrameInfo{Time: time.Now()}, err
+}
+
+func (c *rwFrameConn) WriteFrame(b []byte) error {
+	n, err := c.rw.Write(b)
+	if err == nil && n != len(b) {
+		return io.ErrShortWrite
+	}
+	return err
+}
+
+// PacketFrameConn adapts pc to the FrameConn interface; each datagram is
+// a frame. Frames are written to peer; frames are read from any address,
+// which is reported as FrameInfo.Source.
+func PacketFrameConn(pc net.PacketConn, peer net.Addr) FrameConn {
+	return &packetFrameConn{
+		readFrom: pc.ReadFrom,
+		write: func(b []byte) error {
+			_, err := pc.WriteTo(b, peer)
+			return err
+		},
+	}
+}
+
+// DatagramFrameConn adapts c, a connected datagram socket like one
+// returned by net.DialUDP, to the FrameConn interface; each datagram
+// is a frame. The remote address is reported as FrameInfo.Source.
+func DatagramFrameConn(c net.Conn) FrameConn {
+	raddr := c.RemoteAddr()
+	return &packetFrameConn{
+		readFrom: func(b []byte) (int, net.Addr, error) {
+			n, err := c.Read(b)
+			return n, raddr, err
+		},
+		write: func(b []byte) error {
+			_, err := c.Write(b)
+			return err
+		},
+	}
+}
+
+type packetFrameConn struct {
+	readFrom func(b []byte) (int, net.Addr, error)
+	write    func(b []byte) error
+	buf      []byte
+}
+
+func (c *packetFrameConn) ReadFrame(b []byte) (int, FrameInfo, error) {
+	// read into a buffer that is one byte larger,
+	// so that truncation can be detected
+	if len(c.buf) != len(b)+1 {
+		c.buf = make([]byte, len(b)+1)
+	}
+	n, addr, err := c.readFrom(c.buf)
+	info := FrameInfo{Time: time.Now(), Source: addr}
+	if err != nil {
+		return 0, info, err
+	}
+	if n > len(b) {
+		return copy(b, c.buf), info, ErrFrameTruncated
+	}
+	return copy(b, c.buf[:n]), info, nil
+}
+
+func (c *packetFrameConn) WriteFrame(b []byte) error {
+	return c.write(b)
+}
@@ -0,0 +1,177 @@
+package seg
+
+import "encoding/binary"
+
+// ISOTPConfig configures ISO 15765-2 (ISO-TP) framing, see WithISOTP.
+type ISOTPConfig struct {
+	// Pad enables padding of frames shorter than eight bytes.
+	// Frames longer than eight bytes are always padded
+	// to the next valid CAN FD frame size.
+	Pad     bool
+	PadByte byte
+}
+
+// DefaultISOTPPadByte is used for padding CAN FD frames
+// if ISOTPConfig.Pad is not set.
+const DefaultISOTPPadByte = 0xCC
+
+// WithISOTP selects ISO 15765-2 framing, using single, first,
+// consecutive, and flow control frames, as implemented by ISOTPCodec.
+// The size passed to New is used as the transmit data length (TX_DL);
+// values larger than eight select CAN FD framing with escape sequences.
+// Messages longer than 4095 bytes are announced using 32-bit lengths.
+//
+// Since flow control is an integral part of ISO-TP, it is enabled
+// with default parameters, unless WithFlowControl is used too.
+// WithISOTP overrides WithCodec; custom strategies do not apply.
+func WithISOTP(cfg ISOTPConfig) Option {
+	return func(s *Seg) {
+		s.isotp = &cfg
+	}
+}
+
+// ISOTPCodec implements the ISO 15765-2 header format, see WithISOTP.
+// Single and first frames announce the message length rather than
+// a frame count, using escape sequences for CAN FD single frames,
+// and for lengths above 4095 bytes; consecutive frames carry
+// a sequence number that wraps around after 15.
+type ISOTPCodec struct{}
+
+// protocol control information types
+const (
+	isotpSF = iota // single frame
+	isotpFF        // first frame
+	isotpCF        // consecutive frame
+	isotpFC        // flow control frame
+)
+
+func (ISOTPCodec) HeaderLen(h Header) int {
+	switch h.Kind {
+	case SingleFrame:
+		if h.Len > 7 {
+			return 2
+		}
+	case StartFrame:
+		if h.Len > 0xFFF {
+			return 6
+		}
+		return 2
+	}
+	return 1
+}
+
+func (ISOTPCodec) MaxFrames() int { return 0 }
+func (ISOTPCodec) IndexMod() int  { return 16 }
+
+func (c ISOTPCodec) PutHeader(b []byte, h Header) int {
+	n := c.HeaderLen(h)
+	switch h.Kind {
+	case SingleFrame:
+		if n == 1 {
+			b[0] = byte(h.Len)
+		} else {
+			b[0] = 0
+			b[1] = byte(h.Len)
+		}
+	case StartFrame:
+		if n == 2 {
+			b[0] = isotpFF<<4 | byte(h.Len>>8)
+			b[1] = byte(h.Len)
+		} else {
+			b[0] = isotpFF << 4
+			b[1] = 0
+			binary.BigEndian.PutUint32(b[2:], uint32(h.Len))
+		}
+	case ContFrame:
+		b[0] = isotpCF<<4 | byte(h.Index&0xF)
+	default:
+		b[0] = isotpFC<<4 | h.Status&0xF
+	}
+	return n
+}
+
+func (ISOTPCodec) ParseHeader(b []byte) (h Header, n int, ok bool) {
+	if len(b) == 0 {
+		return h, 0, false
+	}
+	switch b[0] >> 4 {
+	case isotpSF:
+		h = Header{Kind: SingleFrame, Count: 1, Len: int(b[0] & 0xF)}
+		n = 1
+		if h.Len == 0 {
+			// escape sequence
+			if len(b) < 2 {
+				return h, 0, false
+			}
+			h.Len = int(b[1])
+			n = 2
+		}
+		if h.Len == 0 || h.Len > len(b)-n {
+			return h, 0, false
+		}
+	case isotpFF:
+		if len(b) < 2 {
+			return h, 0, false
+		}
+		h = Header{Kind: StartFrame, Len: int(b[0]&0xF)<<8 | int(b[1])}
+		n = 2
+		if h.Len == 0 {
+			// escape sequence, 32-bit length
+			if len(b) < 6 {
+				return h, 0, false
+			}
+			h.Len = int(binary.BigEndian.Uint32(b[2:]))
+			n = 6
+		}
+		if h.Len <= len(b)-n {
+			return h, 0, false
+		}
+	case isotpCF:
+		h = Header{Kind: ContFrame, Index: int(b[0] & 0xF)}
+		n = 1
+	case isotpFC:
+		h = Header{Kind: ControlFrame, Status: b[0] & 0xF}
+		n = 1
+	default:
+		return h, 0, false
+	}
+	return h, n, true
+}
+
+// isotpPadConn pads frames written to a FrameConn
+// as required by an ISO-TP configuration.
+type isotpPadConn struct {
+	FrameConn
+	cfg ISOTPConfig
+	buf []byte // of TX_DL bytes
+}
+
+func (c *isotpPadConn) WriteFrame(b []byte) error {
+	n := len(b)
+	padByte := byte(DefaultISOTPPadByte)
+	if c.cfg.Pad {
+		padByte = c.cfg.PadByte
+		if n < 8 {
+			n = min(8, len(c.buf))
+		}
+	}
+	if n > 8 {
+		// validFDSizes is sorted in descending order
+		fdSize := n
+		for _, size := range validFDSizes {
+			if size >= n && size <= len(c.buf) {
+				fdSize = size
+			}
+		}
+		n = fdSize
+	}
+	if n <= len(b) {
+		return c.FrameConn.WriteFrame(b)
+	}
+	p := c.buf[:n]
+	pad := p[copy(p, b):]
+	for i := range pad {
+		pad[i] = padByte
+	}
+	return c.FrameConn.WriteFrame(p)
+}
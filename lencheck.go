@@ -0,0 +1,47 @@
+package seg
+
+// A LenCheck is called by ReadMsg while a multi-frame message is being
+// reassembled, each time a frame other than the last one has been received.
+// Data contains the part of the message received so far, and min and max
+// are the bounds of the length of the complete message, as far as they can
+// be derived from the frame headers received; if a checksum is used,
+// data may include checksum bytes already.
+//
+// If the function returns an error, reassembly is aborted, and ReadMsg
+// returns the error. The remaining continuation frames of the message
+// are skipped; in flow control mode, the sender is notified.
+type LenCheck func(data []byte, min, max int) error
+
+// SetLenCheck sets the function checking the length of messages being
+// reassembled; nil disables the check. It may be called at any time,
+// and takes effect with the next frame received.
+// Messages are not checked in selective repeat mode, and by a Reassembler.
+func (s *Seg) SetLenCheck(f LenCheck) {
+	if f == nil {
+		s.lenCheck.Store(nil)
+		return
+	}
+	s.lenCheck.Store(&f)
+}
+
+// checkLen calls the length check, if set, for a message
+// of which data has been received so far.
+func (s *Seg) checkLen(data []byte, lo, hi int) error {
+	f := s.lenCheck.Load()
+	if f == nil {
+		return nil
+	}
+	if c := s.checksum; c != nil {
+		lo = max(lo-c.size, 0)
+		hi = max(hi-c.size, 0)
+	}
+	err := (*f)(data, lo, hi)
+	if err != nil {
+		s.skipConts = true
+		s.countStat(&s.stats.RejectedMsgs)
+		if fcErr := s.notifyOverflow(); fcErr != nil {
+			return fcErr
+		}
+	}
+	return err
+}
@@ -3,7 +3,10 @@ package modbus
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/knieriem/modbus"
@@ -18,24 +21,97 @@ type Conn struct {
 	buf  *bytes.Buffer
 
 	stream *serframe.Stream
-	ExitC  chan error
 	dev    io.ReadWriter
+
+	// ExitC receives the first fatal error of the underlying connection,
+	// like a read error after a device has been unplugged, or
+	// an error reporting a CAN bus-off condition. The connection
+	// is not usable anymore then, and should be closed.
+	ExitC    chan error
+	exitOnce sync.Once
+
+	pacer    pacer
+	rejected atomic.Pointer[rejectedResp]
+
+	tagLen  int // length of the transaction tag prefix
+	tag     byte
+	wBuf    []byte
+	pending atomic.Pointer[pendingReq]
+	stale   atomic.Uint64
+	noResp  bool // no response expected for the request sent
 }
 
 func NewNetConn(conn io.ReadWriter, segSize int, name string, options ...seg.Option) *Conn {
 	m := new(Conn)
 	m.Seg = seg.New(conn, segSize, name, options...)
+	m.pacer.Pacing = DefaultPacing
+	m.pacer.init(m.Seg)
 	m.dev = conn
+	m.ExitC = make(chan error, 1)
 
 	m.rBuf = make([]byte, 254)
 	m.buf = new(bytes.Buffer)
 
 	m.stream = serframe.NewStream(nil,
-		serframe.WithInternalReadBytesFunc(m.ReadMsg),
+		serframe.WithInternalReadBytesFunc(m.readMsg),
 	)
 	return m
 }
 
+// readMsg supervises the reception of messages by the stream. Messages
+// discarded due to reassembly errors are skipped, whereas fatal errors
+// are reported on ExitC, and returned.
+func (m *Conn) readMsg() ([]byte, error) {
+	for {
+		msg, err := m.ReadMsg()
+		if err != nil {
+			r := m.rejected.Load()
+			switch {
+			case r != nil && err == r.err:
+				// pass the part received on to Receive,
+				// which will report the error
+				msg = r.msg
+			case !isFatal(err):
+				continue
+			default:
+				m.exitOnce.Do(func() {
+					m.ExitC <- err
+				})
+				return nil, err
+			}
+		}
+		adu, ok := m.match(msg)
+		if !ok {
+			m.rejected.Store(nil)
+			m.stale.Add(1)
+			continue
+		}
+		return adu, nil
+	}
+}
+
+// isFatal reports whether err has been caused by the underlying connection,
+// rather than by a message that had to be discarded, or that could not
+// be delivered due to the seg protocol.
+func isFatal(err error) bool {
+	var ce *seg.ChecksumError
+	var me *seg.MsgSizeError
+	var te *seg.TimeoutError
+	switch {
+	case errors.As(err, &ce), errors.As(err, &me), errors.As(err, &te):
+		return false
+	case errors.Is(err, seg.ErrTooManyFrames),
+		errors.Is(err, seg.ErrFlowControlTimeout),
+		errors.Is(err, seg.ErrFlowControlOverflow),
+		errors.Is(err, seg.ErrFlowControlWait),
+		errors.Is(err, seg.ErrFlowControlStatus),
+		errors.Is(err, seg.ErrAckTimeout),
+		errors.Is(err, seg.ErrRetransmitLimit):
+		return false
+	}
+	return true
+}
+
 func (m *Conn) Name() string {
 	return "seg"
 }
@@ -49,18 +125,27 @@ func (m *Conn) MsgWriter() io.Writer {
 	return m.buf
 }
 
+// Send writes the request written to MsgWriter, and prepares the reception
+// of the response. Broadcast requests, addressed to BroadcastUnit,
+// are sent like using SendOnly.
 func (m *Conn) Send() (adu modbus.ADU, err error) {
 	buf := m.buf.Bytes()
+	if len(buf) != 0 && buf[0] == BroadcastUnit {
+		return m.SendOnly()
+	}
 	adu.PDUStart = 1
 	adu.PDUEnd = 0
 	adu.Bytes = buf
 
+	m.noResp = false
+	m.rejected.Store(nil)
+	m.setPending(buf)
 	err = m.stream.StartReception(m.rBuf)
 	if err != nil {
 		return adu, err
 	}
 
-	_, err = m.Write(buf)
+	_, err = m.write(buf)
 	if err != nil {
 		m.stream.CancelReception()
 	}
@@ -68,24 +153,96 @@ func (m *Conn) Send() (adu modbus.ADU, err error) {
 	return adu, err
 }
 
-func (m *Conn) Receive(ctx context.Context, tMax time.Duration, _ *modbus.ExpectedRespLenSpec) (modbus.ADU, error) {
+// SendOnly writes the request written to MsgWriter, for which no response
+// is expected. The subsequent call to Receive returns immediately, and any
+// message received in the meantime is discarded as a stale reply.
+func (m *Conn) SendOnly() (adu modbus.ADU, err error) {
+	buf := m.buf.Bytes()
+	adu.PDUStart = 1
+	adu.PDUEnd = 0
+	adu.Bytes = buf
+
+	m.noResp = true
+	m.rejected.Store(nil)
+	m.setPending(nil)
+	_, err = m.write(buf)
+	return adu, err
+}
+
+// write writes adu, preceded by the transaction tag, if enabled.
+func (m *Conn) write(adu []byte) (int, error) {
+	msg := adu
+	if m.tagLen != 0 {
+		m.wBuf = append(append(m.wBuf[:0], m.tag), adu...)
+		msg = m.wBuf
+	}
+	return m.Write(msg)
+}
+
+// Receive waits for the response to the request sent. If ersp is not nil,
+// the response is rejected as soon as it is evident that its length
+// does not match the length expected; remaining frames of the response
+// are not waited for. If no response is expected, see SendOnly,
+// Receive returns an empty ADU immediately.
+func (m *Conn) Receive(ctx context.Context, tMax time.Duration, ersp *modbus.ExpectedRespLenSpec) (modbus.ADU, error) {
 	var adu modbus.ADU
 	adu.PDUStart = 1
 	adu.PDUEnd = 0
 
+	if m.noResp {
+		m.noResp = false
+		return adu, nil
+	}
+
+	defer m.pending.Store(nil)
+	if ersp != nil {
+		m.Seg.SetLenCheck(m.respLenCheck(ersp))
+		defer m.Seg.SetLenCheck(nil)
+	}
 	b, err := m.stream.ReadFrame(ctx, serframe.WithInitialTimeout(tMax))
 	adu.Bytes = b
 	if err != nil {
 		err = rtu.ConvertSerframeError(err)
-		if err == modbus.ErrTimeout && m.Seg.PrevWriteMultiple {
-			m.Seg.WriteDelay += 5 * time.Millisecond
+		if err == modbus.ErrTimeout && m.Seg.PrevWriteMultiple() {
+			m.pacer.timeout(m.Seg)
 		}
 		return adu, err
 	}
+	m.pacer.success(m.Seg)
+	if r := m.rejected.Swap(nil); r != nil {
+		return adu, r.err
+	}
 	n := len(adu.Bytes)
 	if n < 2 {
 		err = modbus.NewInvalidLen(modbus.MsgContextADU, n, 2)
 		return adu, err
 	}
-	return adu, nil
+	if ersp != nil {
+		err = checkRespLen(ersp, adu.Bytes)
+	}
+	return adu, err
+}
+
+// ConnStats contains the statistics of the underlying seg.Seg,
+// and of the adaptive write pacing.
+type ConnStats struct {
+	seg.Stats
+	WriteDelay     time.Duration // current delay between frames
+	DelayIncreases uint64
+	DelayDecreases uint64
+	StaleReplies   uint64 // responses not matching the pending request
+}
+
+// Stats returns a snapshot of the counters.
+func (m *Conn) Stats() ConnStats {
+	p := &m.pacer
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ConnStats{
+		Stats:          m.Seg.Stats(),
+		WriteDelay:     m.Seg.WriteDelay(),
+		DelayIncreases: p.increases,
+		DelayDecreases: p.decreases,
+		StaleReplies:   m.stale.Load(),
+	}
 }
@@ -0,0 +1,187 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/knieriem/seg"
+)
+
+// pipe is one end of an in-memory datagram link.
+type pipe struct {
+	r <-chan []byte
+	w chan<- []byte
+}
+
+func newPipe() (a, b *pipe) {
+	c1 := make(chan []byte, 16)
+	c2 := make(chan []byte, 16)
+	return &pipe{r: c1, w: c2}, &pipe{r: c2, w: c1}
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	return copy(b, <-p.r), nil
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+	p.w <- bytes.Clone(b)
+	return len(b), nil
+}
+
+func TestSendOnly(t *testing.T) {
+	a, b := newPipe()
+	m := NewNetConn(a, 8, "client")
+
+	for _, tc := range []struct {
+		name string
+		req  []byte
+		send func() error
+	}{
+		{"broadcast", []byte{BroadcastUnit, 6, 0, 1, 0, 2}, func() error { _, err := m.Send(); return err }},
+		{"send-only", []byte{1, 6, 0, 1, 0, 2}, func() error { _, err := m.SendOnly(); return err }},
+	} {
+		m.MsgWriter().Write(tc.req)
+		if err := tc.send(); err != nil {
+			t.Fatalf("[%s] send failed: %v", tc.name, err)
+		}
+		if f := <-b.r; !bytes.Equal(f[1:], tc.req) {
+			t.Fatalf("[%s] unexpected frame: % x", tc.name, f)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		adu, err := m.Receive(ctx, time.Second, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("[%s] Receive failed: %v", tc.name, err)
+		}
+		if len(adu.Bytes) != 0 {
+			t.Fatalf("[%s] unexpected response: % x", tc.name, adu.Bytes)
+		}
+
+		// a reply arriving nevertheless is stale
+		if _, ok := m.match([]byte{1, 6, 0, 1, 0, 2}); ok {
+			t.Fatalf("[%s] reply accepted", tc.name)
+		}
+	}
+}
+
+// failingConn delivers the frames sent on its channel; once the channel
+// has been closed, Read fails like on a device that has been unplugged.
+type failingConn struct {
+	frames chan []byte
+	err    error
+}
+
+func (c *failingConn) Read(b []byte) (int, error) {
+	f, ok := <-c.frames
+	if !ok {
+		return 0, c.err
+	}
+	return copy(b, f), nil
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestExitC(t *testing.T) {
+	// frames of a response, and a copy with a corrupted checksum
+	a, b := newPipe()
+	resp := []byte{1, 3, 2, 0, 7}
+	seg.New(a, 8, "device", seg.WithCRC16()).Write(resp)
+	var good, bad [][]byte
+	for len(b.r) != 0 {
+		f := <-b.r
+		good = append(good, f)
+		bad = append(bad, bytes.Clone(f))
+	}
+	last := bad[len(bad)-1]
+	last[len(last)-1] ^= 0xFF
+
+	c := &failingConn{frames: make(chan []byte), err: errors.New("unplugged")}
+	m := NewNetConn(c, 8, "client", seg.WithCRC16())
+	m.MsgWriter().Write([]byte{1, 3, 0, 0, 0, 1})
+	if _, err := m.Send(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, f := range append(bad, good...) {
+			c.frames <- f
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	adu, err := m.Receive(ctx, 5*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(adu.Bytes, resp) {
+		t.Fatalf("got % x, want % x", adu.Bytes, resp)
+	}
+	select {
+	case err := <-m.ExitC:
+		t.Fatalf("checksum error reported as fatal: %v", err)
+	default:
+	}
+
+	close(c.frames)
+	select {
+	case err := <-m.ExitC:
+		if err != c.err {
+			t.Fatalf("got %v, want %v", err, c.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read error not reported on ExitC")
+	}
+	if _, err := m.readMsg(); err != c.err {
+		t.Fatalf("readMsg: got %v, want %v", err, c.err)
+	}
+	select {
+	case err := <-m.ExitC:
+		t.Fatalf("reported twice: %v", err)
+	default:
+	}
+	if st := m.Stats(); st.ChecksumErrors != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestIsFatal(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		fatal bool
+	}{
+		{&seg.ChecksumError{}, false},
+		{&seg.MsgSizeError{}, false},
+		{&seg.TimeoutError{}, false},
+		{fmt.Errorf("wrapped: %w", &seg.ChecksumError{}), false},
+		{seg.ErrTooManyFrames, false},
+		{seg.ErrAckTimeout, false},
+		{seg.ErrRetransmitLimit, false},
+		{seg.ErrFlowControlTimeout, false},
+		{io.EOF, true},
+		{errors.New("bus off"), true},
+	} {
+		if got := isFatal(tc.err); got != tc.fatal {
+			t.Errorf("%v: got %v, want %v", tc.err, got, tc.fatal)
+		}
+	}
+}
+
+func TestSetPacing(t *testing.T) {
+	a, _ := newPipe()
+	// a delay configured above the default ceiling is retained
+	m := NewNetConn(a, 8, "client", seg.WithWriteDelay(100*time.Millisecond))
+	if d := m.WriteDelay(); d != 100*time.Millisecond {
+		t.Fatalf("default pacing: got %v, want %v", d, 100*time.Millisecond)
+	}
+	m.SetPacing(Pacing{Floor: 60 * time.Millisecond, Ceiling: 80 * time.Millisecond, Step: time.Millisecond})
+	if d := m.WriteDelay(); d != 80*time.Millisecond {
+		t.Fatalf("got %v, want %v", d, 80*time.Millisecond)
+	}
+}
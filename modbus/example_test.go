@@ -0,0 +1,75 @@
+package modbus_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/knieriem/modbus"
+	"github.com/knieriem/seg"
+	mod "github.com/knieriem/seg/modbus"
+)
+
+// loopback is one end of an in-memory datagram link.
+type loopback struct {
+	r <-chan []byte
+	w chan<- []byte
+}
+
+func newLoopback() (a, b *loopback) {
+	c1 := make(chan []byte, 64)
+	c2 := make(chan []byte, 64)
+	return &loopback{r: c1, w: c2}, &loopback{r: c2, w: c1}
+}
+
+func (l *loopback) Read(b []byte) (int, error) {
+	return copy(b, <-l.r), nil
+}
+
+func (l *loopback) Write(b []byte) (int, error) {
+	l.w <- bytes.Clone(b)
+	return len(b), nil
+}
+
+// This example emulates a device answering "Read Holding Registers"
+// requests, and queries it over an in-memory link.
+func ExampleServer() {
+	client, device := newLoopback()
+
+	srv := mod.NewServer(device, 8, "device", mod.HandlerFunc(func(adu modbus.ADU) ([]byte, error) {
+		req := adu.Bytes[adu.PDUStart:]
+		if req[0] != 3 {
+			return nil, mod.IllegalFunction
+		}
+		if len(req) != 5 {
+			return nil, mod.IllegalDataValue
+		}
+		n := int(binary.BigEndian.Uint16(req[3:]))
+		resp := []byte{3, byte(2 * n)}
+		for i := range n {
+			resp = binary.BigEndian.AppendUint16(resp, uint16(100+i))
+		}
+		return resp, nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	c := seg.New(client, 8, "client")
+	for _, req := range [][]byte{
+		{1, 3, 0, 0, 0, 4}, // read four registers
+		{1, 6, 0, 0, 0, 1}, // write single register
+	} {
+		c.Write(req)
+		resp, err := c.ReadMsg()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("% x\n", resp)
+	}
+	// Output:
+	// 01 03 08 00 64 00 65 00 66 00 67
+	// 01 86 01
+}
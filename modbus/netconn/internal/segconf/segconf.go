@@ -0,0 +1,195 @@
+// Package segconf decodes the "seg." options shared by the
+// netconn protocols based on seg.
+package segconf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knieriem/can"
+	"github.com/knieriem/seg"
+	mod "github.com/knieriem/seg/modbus"
+)
+
+// Config contains the configuration of the seg layer,
+// as specified by options with a "seg." prefix.
+type Config struct {
+	FDMode bool
+	ExtHdr bool
+	CRC    int
+	FC     *seg.FlowControl
+	SR     *seg.SelectiveRepeat
+	ISOTP  *seg.ISOTPConfig
+	Tags   bool
+	SegMax int
+}
+
+// DecodeOptions decodes options with a "seg." prefix, and returns
+// the remaining options. Keys not known to Config are passed to
+// decodeKey, which may be nil.
+func (sc *Config) DecodeOptions(options []string, decodeKey func(key, val string) error) ([]string, error) {
+	rest := options[:0]
+
+	sc.SegMax = 8
+
+	for i, o := range options {
+		stem, ok := strings.CutPrefix(o, "seg.")
+		if !ok {
+			if len(rest) == i {
+				rest = rest[:i+1]
+				continue
+			}
+			rest = append(rest, o)
+			continue
+		}
+		if len(stem) < 2 {
+			return nil, errors.New("seg: syntax error")
+		}
+		before, after, ok0 := strings.Cut(stem, ":")
+		if !ok0 {
+			switch stem {
+			case "fd":
+				sc.FDMode = true
+				continue
+			case "ext":
+				sc.ExtHdr = true
+				continue
+			case "fc":
+				sc.flowControl()
+				continue
+			case "isotp":
+				if sc.ISOTP == nil {
+					sc.ISOTP = new(seg.ISOTPConfig)
+				}
+				continue
+			case "tag":
+				sc.Tags = true
+				continue
+			case "sr":
+				if sc.SR == nil {
+					sc.SR = new(seg.SelectiveRepeat)
+				}
+				continue
+			}
+			return nil, errors.New("seg: missing colon")
+		}
+
+		key, val := before, after
+		switch key {
+		case "max":
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(can.ValidFDSizes, i) {
+				return nil, fmt.Errorf("seg.max: invalid value: %q", val)
+			}
+			sc.SegMax = i
+			sc.FDMode = true
+
+		case "crc":
+			switch val {
+			case "16":
+				sc.CRC = 16
+			case "32":
+				sc.CRC = 32
+			default:
+				return nil, fmt.Errorf("seg.crc: invalid value: %q", val)
+			}
+
+		case "bs":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > 255 {
+				return nil, fmt.Errorf("seg.bs: invalid value: %q", val)
+			}
+			sc.flowControl().BlockSize = n
+
+		case "st":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			sc.flowControl().SepTime = d
+
+		case "sr":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("seg.sr: invalid value: %q", val)
+			}
+			sc.SR = &seg.SelectiveRepeat{Retries: n}
+
+		case "pad":
+			u, err := strconv.ParseUint(val, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("seg.pad: invalid value: %q", val)
+			}
+			sc.ISOTP = &seg.ISOTPConfig{Pad: true, PadByte: byte(u)}
+
+		default:
+			if decodeKey == nil {
+				return nil, fmt.Errorf("seg: invalid key: %q", key)
+			}
+			err := decodeKey(key, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if sc.FDMode && sc.SegMax == 8 {
+		// Ensure default if seg.max has not been set
+		sc.SegMax = 64
+	}
+	return rest, nil
+}
+
+// flowControl enables flow control, returning its configuration.
+func (sc *Config) flowControl() *seg.FlowControl {
+	if sc.FC == nil {
+		sc.FC = new(seg.FlowControl)
+	}
+	return sc.FC
+}
+
+// NewConn creates a Modbus connection on top of rw.
+func (sc *Config) NewConn(rw io.ReadWriter, name string) *mod.Conn {
+	m := mod.NewNetConn(rw, sc.SegMax, name, sc.SegOptions()...)
+	m.SetTransactionTags(sc.Tags)
+	return m
+}
+
+// SegOptions returns the options of the underlying seg.Seg.
+func (sc *Config) SegOptions() []seg.Option {
+	var opts []seg.Option
+	if sc.ExtHdr {
+		opts = append(opts, seg.WithExtendedHeader())
+	}
+	if sc.ISOTP != nil {
+		opts = append(opts, seg.WithISOTP(*sc.ISOTP))
+	}
+	if sc.FC != nil {
+		opts = append(opts, seg.WithFlowControl(*sc.FC))
+	}
+	if sc.SR != nil {
+		opts = append(opts, seg.WithSelectiveRepeat(*sc.SR))
+	}
+	switch sc.CRC {
+	case 16:
+		opts = append(opts, seg.WithCRC16())
+	case 32:
+		opts = append(opts, seg.WithCRC32())
+	}
+	if sc.FDMode {
+		st := seg.CANFDStrategy(sc.SegMax)
+		if sc.ExtHdr {
+			st = seg.CANFDStrategyExt(sc.SegMax)
+		}
+		opts = append(opts, seg.WithStrategy(st))
+	}
+	return opts
+}
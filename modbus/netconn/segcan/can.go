@@ -5,33 +5,64 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/knieriem/can"
 	"github.com/knieriem/modbus/netconn"
+	"github.com/knieriem/seg"
+	"github.com/knieriem/seg/modbus/netconn/internal/segconf"
 )
 
 var (
 	errOut = os.Stderr
 )
 
+// ErrBusOff is returned by reads once the CAN controller
+// reports a bus-off condition.
+var ErrBusOff = errors.New("segcan: CAN bus-off")
+
 type canRW struct {
 	*netconn.Conf
+	segconf.Config
+	*FrameConn
+	tx, rx ID
+}
+
+// ID is a CAN identifier.
+type ID struct {
+	ID  uint32
+	Ext bool // extended identifier
+}
+
+// FrameConn transfers frames as messages over a CAN device.
+// It implements seg.FrameConn, and io.ReadWriteCloser.
+type FrameConn struct {
 	dev       can.Device
+	tx, rx    ID
+	maxSize   int
 	buf, rBuf []can.Msg
+	rTime     time.Time // time the messages in rBuf have been read
+}
 
-	fdMode bool
-	txID   uint32
-	rxID   uint32
-	txExt  bool
-	rxExt  bool
-	segMax int
+// NewFrameConn creates a FrameConn that writes frames as messages
+// with identifier tx, and reads frames from messages with identifier rx.
+// Frames larger than maxSize are rejected with seg.ErrFrameTooLarge.
+func NewFrameConn(dev can.Device, tx, rx ID, maxSize int) *FrameConn {
+	return &FrameConn{
+		dev:     dev,
+		tx:      tx,
+		rx:      rx,
+		maxSize: maxSize,
+		buf:     make([]can.Msg, 64),
+	}
 }
 
-func openCAN(cf *netconn.Conf) (*canRW, error) {
+// openCAN decodes the options of cf, and opens the device
+// using the specified function, usually can.Open.
+func openCAN(cf *netconn.Conf, open func(devSpec string) (can.Device, error)) (*canRW, error) {
 	devSpec := cf.Device
 
 	var c canRW
@@ -43,98 +74,46 @@ func openCAN(cf *netconn.Conf) (*canRW, error) {
 	if len(cf.Options) != 0 {
 		devSpec += "," + strings.Join(cf.Options, ",")
 	}
-	if c.rxExt {
-		devSpec += "," + fmt.Sprintf("f%08x", c.rxID)
+	if c.rx.Ext {
+		devSpec += "," + fmt.Sprintf("f%08x", c.rx.ID)
 	} else {
-		devSpec += "," + fmt.Sprintf("f%03x", c.rxID)
+		devSpec += "," + fmt.Sprintf("f%03x", c.rx.ID)
 	}
 
-	dev, err := can.Open(devSpec)
+	dev, err := open(devSpec)
 	if err != nil {
 		return nil, err
 	}
 
 	c.Conf = cf
-	c.dev = dev
-	c.buf = make([]can.Msg, 64)
+	c.FrameConn = NewFrameConn(dev, c.tx, c.rx, c.SegMax)
 	return &c, nil
 }
 
 func decodeOptions(c *canRW, cf *netconn.Conf) error {
-	canOpts := cf.Options[:0]
-
-	c.segMax = 8
-
 	// Use defaults from deprecated, explicit fields
-	c.txID = cf.Txid.ID
-	c.txExt = cf.Txid.Extframe
-	c.rxID = cf.Rxid.ID
-	c.rxExt = cf.Rxid.Extframe
-
-	for i, o := range cf.Options {
-		stem, ok := strings.CutPrefix(o, "seg.")
-		if !ok {
-			if len(canOpts) == i {
-				canOpts = canOpts[:i+1]
-				continue
-			}
-			canOpts = append(canOpts, o)
-			continue
-		}
-		if len(stem) < 2 {
-			return errors.New("seg: syntax error")
-		}
-		before, after, ok0 := strings.Cut(stem, ":")
-		if !ok0 {
-			if stem == "fd" {
-				c.fdMode = true
-				continue
-			}
-			return errors.New("seg: missing colon")
-		}
+	c.tx = ID{cf.Txid.ID, cf.Txid.Extframe}
+	c.rx = ID{cf.Rxid.ID, cf.Rxid.Extframe}
 
-		key, val := before, after
+	canOpts, err := c.Config.DecodeOptions(cf.Options, func(key, val string) error {
+		var err error
 		switch key {
-		case "max":
-			i, err := strconv.Atoi(val)
-			if err != nil {
-				return err
-			}
-			if !slices.Contains(can.ValidFDSizes, i) {
-				return fmt.Errorf("seg.max: invalid value: %q", val)
-			}
-			c.segMax = i
-			c.fdMode = true
-
 		case "tx":
-			id, ext, err := parseID(val)
-			if err != nil {
-				return err
-			}
-			c.txID = id
-			c.txExt = ext
-
+			c.tx.ID, c.tx.Ext, err = parseID(val)
 		case "rx":
-			id, ext, err := parseID(val)
-			if err != nil {
-				return err
-			}
-			c.rxID = id
-			c.rxExt = ext
-
+			c.rx.ID, c.rx.Ext, err = parseID(val)
 		default:
-			return fmt.Errorf("seg: invalid key: %q", key)
+			err = fmt.Errorf("seg: invalid key: %q", key)
 		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
-
-	if c.fdMode && c.segMax == 8 {
-		// Ensure default if seg.max has not been set
-		c.segMax = 64
-	}
-	if c.txID == 0 {
+	if c.tx.ID == 0 {
 		return errors.New("seg: missing tx id")
 	}
-	if c.rxID == 0 {
+	if c.rx.ID == 0 {
 		return errors.New("seg: missing rx id")
 	}
 	cf.Options = canOpts
@@ -153,7 +132,16 @@ func parseID(v string) (id uint32, extFrame bool, err error) {
 	return uint32(u), extFrame, nil
 }
 
-func (c *canRW) Read(buf []byte) (n int, err error) {
+func (c *FrameConn) Read(buf []byte) (int, error) {
+	n, _, err := c.ReadFrame(buf)
+	return n, err
+}
+
+// ReadFrame implements seg.FrameConn. It skips status messages,
+// and messages not matching the receive identifier. FrameInfo.Time
+// is the time the batch of messages containing the frame has been
+// read from the device, not a timestamp recorded by the driver.
+func (c *FrameConn) ReadFrame(buf []byte) (n int, info seg.FrameInfo, err error) {
 	for {
 		if len(c.rBuf) == 0 {
 			err = c.fillBuf()
@@ -164,22 +152,27 @@ func (c *canRW) Read(buf []byte) (n int, err error) {
 		msg := &c.rBuf[0]
 		c.rBuf = c.rBuf[1:]
 		if msg.IsStatus() {
+			if msg.Test(can.BusOff) {
+				return 0, info, ErrBusOff
+			}
 			continue
 		}
-		if c.rxExt != msg.ExtFrame() {
+		if c.rx.Ext != msg.ExtFrame() {
 			continue
 		}
-		if msg.Id == c.rxID {
+		if msg.Id == c.rx.ID {
+			info = seg.FrameInfo{Time: c.rTime, Source: msg.Id}
 			data := msg.Data()
-			copy(buf, data)
-			n = len(data)
-			break
+			n = copy(buf, data)
+			if n < len(data) {
+				err = seg.ErrFrameTruncated
+			}
+			return
 		}
 	}
-	return
 }
 
-func (c *canRW) fillBuf() (err error) {
+func (c *FrameConn) fillBuf() (err error) {
 	n, err := c.dev.Read(c.buf)
 	if err != nil {
 		return
@@ -188,24 +181,36 @@ func (c *canRW) fillBuf() (err error) {
 		err = errors.New("zero messages in CAN buffer")
 	}
 	c.rBuf = c.buf[:n]
+	c.rTime = time.Now()
 	return
 }
 
-func (c *canRW) Write(buf []byte) (n int, err error) {
+func (c *FrameConn) Write(buf []byte) (int, error) {
+	err := c.WriteFrame(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// WriteFrame implements seg.FrameConn.
+func (c *FrameConn) WriteFrame(buf []byte) error {
 	var m can.Msg
 	var data can.PlainData
 
-	if c.txExt {
+	if len(buf) > c.maxSize {
+		return seg.ErrFrameTooLarge
+	}
+	if c.tx.Ext {
 		m.Flags |= can.ExtFrame
 	}
-	m.Id = c.txID
+	m.Id = c.tx.ID
 	data = buf
 	m.Attach(&data)
-	err = c.dev.WriteMsg(&m)
-	return
+	return c.dev.WriteMsg(&m)
 }
 
-func (c *canRW) Close() error {
+func (c *FrameConn) Close() error {
 	return c.dev.Close()
 }
 
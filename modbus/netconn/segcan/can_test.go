@@ -0,0 +1,168 @@
+package segcan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/knieriem/can"
+	"github.com/knieriem/modbus"
+	"github.com/knieriem/modbus/netconn"
+	"github.com/knieriem/seg"
+	mod "github.com/knieriem/seg/modbus"
+	"github.com/knieriem/seg/modbus/netconn/internal/segconf"
+	"github.com/knieriem/seg/vcan"
+)
+
+func TestDecodeOptions(t *testing.T) {
+	for _, tc := range []struct {
+		opts    []string
+		want    canRW
+		canOpts []string
+		err     bool
+	}{
+		{
+			opts:    []string{"500k", "seg.tx:123", "seg.rx:18FA1900", "x"},
+			want:    canRW{Config: segconf.Config{SegMax: 8}, tx: ID{0x123, false}, rx: ID{0x18FA1900, true}},
+			canOpts: []string{"500k", "x"},
+		},
+		{
+			opts: []string{"seg.tx:1", "seg.rx:2", "seg.max:32", "seg.crc:16", "seg.tag", "seg.ext"},
+			want: canRW{Config: segconf.Config{SegMax: 32, FDMode: true, CRC: 16, Tags: true, ExtHdr: true}, tx: ID{1, false}, rx: ID{2, false}},
+		},
+		{
+			opts: []string{"seg.tx:1", "seg.rx:2", "seg.fd"},
+			want: canRW{Config: segconf.Config{SegMax: 64, FDMode: true}, tx: ID{1, false}, rx: ID{2, false}},
+		},
+		{opts: []string{"seg.tx:1"}, err: true},
+		{opts: []string{"seg.tx:1", "seg.rx:2", "seg.max:30"}, err: true},
+		{opts: []string{"seg.tx:1", "seg.rx:2", "seg.crc:8"}, err: true},
+		{opts: []string{"seg.tx:1", "seg.rx:2", "seg.local:x"}, err: true},
+		{opts: []string{"seg.tx:1", "seg.rx:2", "seg.x"}, err: true},
+	} {
+		var c canRW
+		cf := &netconn.Conf{Options: slices.Clone(tc.opts)}
+		err := decodeOptions(&c, cf)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.opts, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.opts, c, tc.want)
+		}
+		if !slices.Equal(cf.Options, tc.canOpts) {
+			t.Errorf("%q: CAN options: got %q, want %q", tc.opts, cf.Options, tc.canOpts)
+		}
+	}
+}
+
+// openVCAN opens a device on a virtual bus of package vcan,
+// like openCAN opens devices using can.Open.
+func openVCAN(t *testing.T, bus string, opts ...string) *canRW {
+	t.Helper()
+	c, err := openCAN(&netconn.Conf{Device: bus, Options: opts}, func(devSpec string) (can.Device, error) {
+		return vcan.Open(devSpec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConn(t *testing.T) {
+	opts := []string{"seg.max:64", "seg.crc:16", "seg.tag"}
+	f := openVCAN(t, "conn", append([]string{"500k", "fd", "seg.tx:123", "seg.rx:321"}, opts...)...)
+	client := f.NewConn(f, "can")
+
+	// the server emulates a device echoing requests
+	peer := openVCAN(t, "conn", append([]string{"fd", "seg.tx:321", "seg.rx:123"}, opts...)...)
+	srv := mod.NewServer(peer, peer.SegMax, "server", mod.HandlerFunc(func(req modbus.ADU) ([]byte, error) {
+		return req.Bytes[req.PDUStart:], nil
+	}), peer.SegOptions()...)
+	srv.SetTransactionTags(peer.Tags)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	// a request consisting of multiple CAN FD frames
+	req := append([]byte{1, 0x10, 0, 0, 0, 40, 80}, bytes.Repeat([]byte{0xAA}, 80)...)
+	for i := range 2 {
+		client.MsgWriter().Write(req)
+		_, err := client.Send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		adu, err := client.Receive(ctx, 5*time.Second, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(adu.Bytes, req) {
+			t.Fatalf("[%d] got % x, want % x", i, adu.Bytes, req)
+		}
+	}
+	if st := client.Stats(); st.FramesSent < 4 || st.MsgsReceived != 2 || st.StaleReplies != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestBusOff(t *testing.T) {
+	f := openVCAN(t, "busoff", "seg.tx:1", "seg.rx:2")
+	client := f.NewConn(f, "can")
+
+	bus := vcan.GetBus("busoff")
+	bus.Inject(can.Msg{Flags: can.StatusMsg | can.ErrorPassive})
+	bus.Inject(can.Msg{Flags: can.StatusMsg | can.BusOff})
+	select {
+	case err := <-client.ExitC:
+		if !errors.Is(err, ErrBusOff) {
+			t.Errorf("got %v, want %v", err, ErrBusOff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bus-off not reported on ExitC")
+	}
+}
+
+func TestFrameConn(t *testing.T) {
+	bus := vcan.GetBus("frameconn")
+	n1, err := bus.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := bus.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewFrameConn(n1, ID{ID: 0x10}, ID{ID: 0x18FA1900, Ext: true}, 8)
+	b := NewFrameConn(n2, ID{ID: 0x18FA1900, Ext: true}, ID{ID: 0x10}, 8)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.WriteFrame(make([]byte, 9)); err != seg.ErrFrameTooLarge {
+		t.Errorf("got %v, want %v", err, seg.ErrFrameTooLarge)
+	}
+	if err := a.WriteFrame([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	n, info, err := b.ReadFrame(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Time.IsZero() {
+		t.Error("missing reception time")
+	}
+	if !bytes.Equal(buf[:n], []byte{1, 2, 3}) || info.Source != uint32(0x10) {
+		t.Errorf("got % x from %v", buf[:n], info.Source)
+	}
+}
@@ -1,9 +1,8 @@
 package segcan
 
 import (
+	"github.com/knieriem/can"
 	"github.com/knieriem/modbus/netconn"
-	"github.com/knieriem/seg"
-	mod "github.com/knieriem/seg/modbus"
 )
 
 func init() {
@@ -16,7 +15,7 @@ func init() {
 }
 
 func dial(cf *netconn.Conf) (conn *netconn.Conn, err error) {
-	f, err := openCAN(cf)
+	f, err := openCAN(cf, can.Open)
 	if err != nil {
 		return
 	}
@@ -25,11 +24,7 @@ func dial(cf *netconn.Conf) (conn *netconn.Conn, err error) {
 	id := info.String()
 	f.dev = devWrapper.wrap(f.dev, id)
 
-	var opts []seg.Option
-	if f.fdMode {
-		opts = append(opts, seg.WithStrategy(seg.CANFDStrategy(f.segMax)))
-	}
-	nc := mod.NewNetConn(f, f.segMax, "can", opts...)
+	nc := f.NewConn(f, "can")
 
 	conn = &netconn.Conn{
 		Addr:       cf.MakeAddr(id, true),
@@ -0,0 +1,109 @@
+// Package segudp registers the seg/udp protocol with package netconn,
+// which transfers seg frames as UDP datagrams, like sent by gateways
+// forwarding CAN frames over Ethernet.
+package segudp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/knieriem/modbus/netconn"
+	"github.com/knieriem/seg"
+	"github.com/knieriem/seg/modbus/netconn/internal/segconf"
+)
+
+func init() {
+	netconn.RegisterProtocol(&netconn.Proto{
+		Name:           "seg/udp",
+		OptionalFields: netconn.DevFields,
+		Dial:           dial,
+	})
+}
+
+// udpRW transfers frames as UDP datagrams. It implements seg.FrameConn.
+type udpRW struct {
+	segconf.Config
+	seg.FrameConn
+	conn  *net.UDPConn
+	raddr *net.UDPAddr
+}
+
+// openUDP opens a UDP socket connected to the remote address
+// specified as device, so that datagrams from other sources are
+// discarded. The local address may be specified using the
+// seg.local option; by default, an ephemeral port is used.
+func openUDP(cf *netconn.Conf) (*udpRW, error) {
+	var u udpRW
+	var laddr *net.UDPAddr
+	rest, err := u.DecodeOptions(cf.Options, func(key, val string) error {
+		if key != "local" {
+			return fmt.Errorf("seg: invalid key: %q", key)
+		}
+		a, err := net.ResolveUDPAddr("udp", val)
+		if err != nil {
+			return fmt.Errorf("seg.local: %w", err)
+		}
+		laddr = a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("seg/udp: invalid options: %q", rest)
+	}
+	u.raddr, err = net.ResolveUDPAddr("udp", cf.Device)
+	if err != nil {
+		return nil, err
+	}
+	u.conn, err = net.DialUDP("udp", laddr, u.raddr)
+	if err != nil {
+		return nil, err
+	}
+	u.FrameConn = seg.DatagramFrameConn(u.conn)
+	return &u, nil
+}
+
+func (u *udpRW) WriteFrame(buf []byte) error {
+	if len(buf) > u.SegMax {
+		return seg.ErrFrameTooLarge
+	}
+	return u.FrameConn.WriteFrame(buf)
+}
+
+func (u *udpRW) Read(buf []byte) (int, error) {
+	n, _, err := u.ReadFrame(buf)
+	return n, err
+}
+
+func (u *udpRW) Write(buf []byte) (int, error) {
+	err := u.WriteFrame(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (u *udpRW) Close() error {
+	return u.conn.Close()
+}
+
+func dial(cf *netconn.Conf) (conn *netconn.Conn, err error) {
+	u, err := openUDP(cf)
+	if err != nil {
+		return
+	}
+
+	id := u.raddr.String()
+	nc := u.NewConn(u, "udp")
+
+	conn = &netconn.Conn{
+		Addr:       cf.MakeAddr(id, true),
+		DeviceName: id,
+		DeviceInfo: fmt.Sprintf("\t(%s)", u.conn.LocalAddr()),
+		NetConn:    nc,
+		Closer:     u,
+		ExitC:      nc.ExitC,
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package segudp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knieriem/modbus/netconn"
+	"github.com/knieriem/seg"
+)
+
+func TestUDP(t *testing.T) {
+	gw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer gw.Close()
+
+	u, err := openUDP(&netconn.Conf{
+		Device:  gw.LocalAddr().String(),
+		Options: []string{"seg.fd", "seg.local:127.0.0.1:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if u.SegMax != 64 {
+		t.Fatalf("segMax: got %d, want 64", u.SegMax)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	gw.SetReadDeadline(deadline)
+	u.conn.SetReadDeadline(deadline)
+
+	st := seg.WithStrategy(seg.CANFDStrategy(64))
+	client := seg.New(u, u.SegMax, "client", st)
+	gateway := seg.NewFromFrameConn(seg.PacketFrameConn(gw, nil), 64, "gateway", st)
+
+	req := bytes.Repeat([]byte{1, 2, 3}, 70)
+	_, err = client.Write(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, info, err := gateway.ReadMsgInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, req) {
+		t.Fatalf("request: got % x", msg)
+	}
+	src, ok := info.Source.(net.Addr)
+	if !ok || src.String() != u.conn.LocalAddr().String() {
+		t.Fatalf("source: got %v, want %v", info.Source, u.conn.LocalAddr())
+	}
+
+	// datagrams from other sources are discarded
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = other.WriteTo([]byte{0x80, 's', 'p', 'o', 'o', 'f'}, u.conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := []byte("response")
+	reply := seg.NewFromFrameConn(seg.PacketFrameConn(gw, src), 64, "gateway", st)
+	_, err = reply.Write(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = client.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, resp) {
+		t.Fatalf("response: got % x", msg)
+	}
+}
+
+func TestUDP_InvalidOptions(t *testing.T) {
+	for _, opts := range [][]string{
+		{"seg.tx:123"},
+		{"seg.local:127.0.0.1:x"},
+		{"bitrate=500k"},
+	} {
+		_, err := openUDP(&netconn.Conf{Device: "127.0.0.1:9", Options: opts})
+		if err == nil {
+			t.Errorf("%q: no error", opts)
+		}
+	}
+}
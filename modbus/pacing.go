@@ -0,0 +1,108 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knieriem/seg"
+)
+
+// Pacing configures the adaptation of the delay between frames of
+// multi-frame requests, see seg.Seg.SetWriteDelay. Each time a
+// multi-frame request is followed by a response timeout, the delay
+// is increased by Step, up to Ceiling. After DecayAfter successful
+// exchanges in a row, it is decreased by Step, down to Floor.
+//
+// A zero Step disables the adaptation, a zero Ceiling
+// means no upper limit, and a zero DecayAfter means that
+// the delay is never decreased.
+type Pacing struct {
+	Floor      time.Duration
+	Ceiling    time.Duration
+	Step       time.Duration
+	DecayAfter int
+}
+
+// DefaultPacing is used by NewNetConn, unless changed using SetPacing.
+var DefaultPacing = Pacing{
+	Ceiling:    50 * time.Millisecond,
+	Step:       5 * time.Millisecond,
+	DecayAfter: 32,
+}
+
+// SetPacing configures the adaptive write pacing. The current
+// write delay is limited to the range configured by p.
+func (m *Conn) SetPacing(p Pacing) {
+	m.pacer.mu.Lock()
+	defer m.pacer.mu.Unlock()
+	m.pacer.Pacing = p
+	m.pacer.nOK = 0
+	m.pacer.set(m.Seg, m.Seg.WriteDelay())
+}
+
+type pacer struct {
+	Pacing
+
+	mu        sync.Mutex
+	nOK       int // successful exchanges since the last change
+	increases uint64
+	decreases uint64
+}
+
+// init raises the initial write delay of s to the floor, if necessary.
+// A delay configured above the ceiling is retained; the ceiling is
+// raised accordingly, so that the delay is never reduced below
+// the value the user has chosen.
+func (p *pacer) init(s *seg.Seg) {
+	d := s.WriteDelay()
+	if p.Ceiling != 0 && d > p.Ceiling {
+		p.Ceiling = d
+	}
+	p.set(s, d)
+}
+
+// timeout increases the write delay of s after a response
+// to a multi-frame request timed out.
+func (p *pacer) timeout(s *seg.Seg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Step == 0 {
+		return
+	}
+	p.nOK = 0
+	if p.set(s, s.WriteDelay()+p.Step) {
+		p.increases++
+	}
+}
+
+// success decreases the write delay of s once
+// enough exchanges have been successful in a row.
+func (p *pacer) success(s *seg.Seg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Step == 0 || p.DecayAfter == 0 {
+		return
+	}
+	p.nOK++
+	if p.nOK < p.DecayAfter {
+		return
+	}
+	p.nOK = 0
+	if p.set(s, s.WriteDelay()-p.Step) {
+		p.decreases++
+	}
+}
+
+// set sets the write delay of s to d, limited to the configured range,
+// and reports whether the delay has changed.
+func (p *pacer) set(s *seg.Seg, d time.Duration) bool {
+	d = max(d, p.Floor)
+	if p.Ceiling != 0 {
+		d = min(d, p.Ceiling)
+	}
+	if d == s.WriteDelay() {
+		return false
+	}
+	s.SetWriteDelay(d)
+	return true
+}
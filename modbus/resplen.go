@@ -0,0 +1,70 @@
+package modbus
+
+import (
+	"github.com/knieriem/modbus"
+	"github.com/knieriem/seg"
+)
+
+// exceptionADULen is the length of an exception response: the unit
+// identifier, the function code, and the exception code.
+const exceptionADULen = 3
+
+// expectedADULen returns the length of a response according to ersp,
+// as far as it can be derived from the beginning of the response.
+func expectedADULen(ersp *modbus.ExpectedRespLenSpec, adu []byte) (n int, ok bool) {
+	if len(adu) < 2 {
+		return 0, false
+	}
+	if adu[1]&0x80 != 0 {
+		return exceptionADULen, true
+	}
+	if ersp.BytecountPos == 0 {
+		return 1 + ersp.N, true
+	}
+	i := 1 + ersp.BytecountPos
+	if len(adu) <= i {
+		return 0, false
+	}
+	return 1 + ersp.N + int(adu[i]), true
+}
+
+// respLenCheck returns a seg.LenCheck that rejects a response as soon as
+// its frame headers show that it cannot have the expected length.
+// A rejected response is stored in m.rejected.
+func (m *Conn) respLenCheck(ersp *modbus.ExpectedRespLenSpec) seg.LenCheck {
+	return func(data []byte, min, max int) error {
+		h := m.tagLen
+		if len(data) < h {
+			return nil
+		}
+		adu := data[h:]
+		min -= h
+		max -= h
+		n, ok := expectedADULen(ersp, adu)
+		if !ok || n >= min && n <= max {
+			return nil
+		}
+		got := min
+		if n > max {
+			got = max
+		}
+		err := modbus.NewInvalidLen(modbus.MsgContextADU, got, n)
+		m.rejected.Store(&rejectedResp{msg: append([]byte(nil), data...), err: err})
+		return err
+	}
+}
+
+// rejectedResp is a response rejected by a length check.
+type rejectedResp struct {
+	msg []byte // part received
+	err error
+}
+
+// checkRespLen verifies that a complete response has the length expected.
+func checkRespLen(ersp *modbus.ExpectedRespLenSpec, adu []byte) error {
+	n, ok := expectedADULen(ersp, adu)
+	if !ok || n == len(adu) {
+		return nil
+	}
+	return modbus.NewInvalidLen(modbus.MsgContextADU, len(adu), n)
+}
@@ -0,0 +1,73 @@
+package modbus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/knieriem/modbus"
+)
+
+func TestRespLenCheck(t *testing.T) {
+	// read holding registers: function code, byte count, data
+	ersp := &modbus.ExpectedRespLenSpec{BytecountPos: 1, N: 2}
+
+	cases := []struct {
+		name     string
+		adu      []byte
+		min, max int
+		reject   bool
+	}{
+		{"normal", []byte{1, 3, 20, 0, 0, 0}, 16, 28, false},
+		{"normal-incomplete", []byte{1, 3}, 16, 28, false},
+		{"exception", []byte{1, 0x83, 2}, 3, 3, false},
+		{"exception-long", []byte{1, 0x83, 2, 0, 0, 0, 0}, 9, 21, true},
+		{"too-short", []byte{1, 3, 20, 0, 0, 0, 0}, 9, 21, true},
+		{"too-long", []byte{1, 3, 4, 0, 0, 0, 0}, 9, 21, true},
+	}
+	for _, tc := range cases {
+		m := new(Conn)
+		err := m.respLenCheck(ersp)(tc.adu, tc.min, tc.max)
+		if reject := err != nil; reject != tc.reject {
+			t.Fatalf("[%s] unexpected result: %v", tc.name, err)
+		}
+		r := m.rejected.Load()
+		if tc.reject && (r == nil || r.err != err) {
+			t.Fatalf("[%s] rejected response not stored", tc.name)
+		}
+	}
+}
+
+func TestCheckRespLen(t *testing.T) {
+	ersp := &modbus.ExpectedRespLenSpec{BytecountPos: 1, N: 2}
+
+	cases := []struct {
+		name string
+		adu  []byte
+		ok   bool
+	}{
+		{"normal", []byte{1, 3, 4, 0, 1, 0, 2}, true},
+		{"exception", []byte{1, 0x83, 2}, true},
+		{"exception-long", []byte{1, 0x83, 2, 0}, false},
+		{"short", []byte{1, 3, 4, 0, 1}, false},
+		{"long", []byte{1, 3, 4, 0, 1, 0, 2, 0}, false},
+	}
+	for _, tc := range cases {
+		err := checkRespLen(ersp, tc.adu)
+		if ok := err == nil; ok != tc.ok {
+			t.Fatalf("[%s] unexpected result: %v", tc.name, err)
+		}
+		var le *modbus.InvalidLenError
+		if err != nil && !errors.As(err, &le) {
+			t.Fatalf("[%s] unexpected error type: %T", tc.name, err)
+		}
+	}
+
+	// fixed length response, like write single register
+	ersp = &modbus.ExpectedRespLenSpec{N: 5}
+	if err := checkRespLen(ersp, []byte{1, 6, 0, 1, 0, 3}); err != nil {
+		t.Fatalf("fixed length: %v", err)
+	}
+	if err := checkRespLen(ersp, []byte{1, 6, 0, 1, 0}); err == nil {
+		t.Fatal("fixed length: short response accepted")
+	}
+}
@@ -0,0 +1,126 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/knieriem/modbus"
+	"github.com/knieriem/seg"
+)
+
+// A Handler processes a request, and returns the PDU of the response.
+// The request is passed as a modbus.ADU laid out like those exchanged
+// by Conn: Bytes starts with the unit identifier, which is followed
+// by the PDU at PDUStart. If the handler returns an Exception,
+// an exception response is sent; other errors result in a
+// ServerDeviceFailure exception. If both resp and err are nil,
+// no response is sent.
+type Handler interface {
+	ServeModbus(req modbus.ADU) (resp []byte, err error)
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(req modbus.ADU) (resp []byte, err error)
+
+func (f HandlerFunc) ServeModbus(req modbus.ADU) ([]byte, error) {
+	return f(req)
+}
+
+// Exception is a Modbus exception code, returned by a Handler to request
+// an exception response. It is defined here, because the errors of the
+// modbus package that Conn relies on, ErrTimeout and *InvalidLenError,
+// describe failures of a client, and carry no exception code.
+type Exception byte
+
+const (
+	IllegalFunction     Exception = 1
+	IllegalDataAddress  Exception = 2
+	IllegalDataValue    Exception = 3
+	ServerDeviceFailure Exception = 4
+)
+
+func (e Exception) Error() string {
+	return fmt.Sprintf("modbus exception %d", byte(e))
+}
+
+// BroadcastUnit is the unit identifier of broadcast requests,
+// which are passed to the handler, but never answered.
+const BroadcastUnit = 0
+
+// Server answers Modbus requests received over a seg connection,
+// emulating one or more devices. Requests and responses are
+// transferred like by Conn: a message consists of the unit
+// identifier, followed by the PDU.
+type Server struct {
+	*seg.Seg
+	h      Handler
+	resp   []byte
+	tagLen int
+}
+
+// NewServer creates a Server for conn, which dispatches requests to h.
+func NewServer(conn io.ReadWriter, segSize int, name string, h Handler, opts ...seg.Option) *Server {
+	return &Server{
+		Seg: seg.New(conn, segSize, name, opts...),
+		h:   h,
+	}
+}
+
+// Serve reads requests, and writes the responses returned by the handler,
+// until ctx is done, or a fatal error occurs, which is returned.
+// Messages discarded due to reassembly errors, and messages too short
+// to contain a function code are skipped.
+func (srv *Server) Serve(ctx context.Context) error {
+	for {
+		msg, err := srv.ReadMsgContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !isFatal(err) {
+				continue
+			}
+			return err
+		}
+		h := srv.tagLen
+		if len(msg) < h+2 {
+			continue
+		}
+		err = srv.serve(msg[:h], modbus.ADU{Bytes: msg[h:], PDUStart: 1})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serve passes a request to the handler, and writes the response,
+// preceded by the transaction tag, if any.
+func (srv *Server) serve(tag []byte, req modbus.ADU) error {
+	unit, fc := req.Bytes[0], req.Bytes[req.PDUStart]
+	resp, err := srv.h.ServeModbus(req)
+	if unit == BroadcastUnit {
+		return nil
+	}
+	b := append(append(srv.resp[:0], tag...), unit)
+	switch {
+	case err != nil:
+		var e Exception
+		if !errors.As(err, &e) {
+			e = ServerDeviceFailure
+		}
+		b = append(b, fc|0x80, byte(e))
+	case resp != nil:
+		b = append(b, resp...)
+	default:
+		return nil
+	}
+	srv.resp = b
+	_, err = srv.Write(b)
+	if err != nil && !isFatal(err) {
+		// the client will time out
+		return nil
+	}
+	return err
+}
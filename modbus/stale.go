@@ -0,0 +1,66 @@
+package modbus
+
+// SetTransactionTags enables prefixing each request with a transaction tag,
+// a sequence number that the server echoes in its response. This allows
+// Conn to recognize stale responses even if they match the unit identifier
+// and function code of the pending request. Both peers must enable tags,
+// see Server.SetTransactionTags. It must be called before the first
+// request is sent.
+func (m *Conn) SetTransactionTags(enable bool) {
+	m.tagLen = tagLen(enable)
+}
+
+// SetTransactionTags makes the server expect a transaction tag in front of
+// each request, which is echoed in the response, see Conn.SetTransactionTags.
+// It must be called before Serve.
+func (srv *Server) SetTransactionTags(enable bool) {
+	srv.tagLen = tagLen(enable)
+}
+
+func tagLen(enable bool) int {
+	if enable {
+		return 1
+	}
+	return 0
+}
+
+// pendingReq identifies the request a response is expected for.
+type pendingReq struct {
+	tag  byte
+	unit byte
+	fc   byte
+}
+
+// setPending registers the request contained in adu as pending,
+// after assigning a new transaction tag, if enabled. If adu is nil,
+// no response is expected.
+func (m *Conn) setPending(adu []byte) {
+	m.tag++
+	if len(adu) < 2 {
+		m.pending.Store(nil)
+		return
+	}
+	m.pending.Store(&pendingReq{tag: m.tag, unit: adu[0], fc: adu[1]})
+}
+
+// match checks whether msg is a response to the pending request,
+// and returns the ADU contained. Messages too short to be checked
+// are passed on, so that Receive can report them.
+func (m *Conn) match(msg []byte) (adu []byte, ok bool) {
+	h := m.tagLen
+	if len(msg) < h+2 {
+		return msg[min(h, len(msg)):], true
+	}
+	p := m.pending.Load()
+	if p == nil {
+		return nil, false
+	}
+	if h != 0 && msg[0] != p.tag {
+		return nil, false
+	}
+	adu = msg[h:]
+	if adu[0] != p.unit || adu[1]&^0x80 != p.fc {
+		return nil, false
+	}
+	return adu, true
+}
@@ -0,0 +1,55 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m := new(Conn)
+	if _, ok := m.match([]byte{1, 3, 2, 0, 1}); ok {
+		t.Fatal("response accepted without pending request")
+	}
+
+	m.setPending([]byte{1, 3, 0, 0, 0, 1})
+	cases := []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"normal", []byte{1, 3, 2, 0, 1}, true},
+		{"exception", []byte{1, 0x83, 2}, true},
+		{"unit", []byte{2, 3, 2, 0, 1}, false},
+		{"function", []byte{1, 4, 2, 0, 1}, false},
+		{"short", []byte{1}, true},
+	}
+	for _, tc := range cases {
+		adu, ok := m.match(tc.msg)
+		if ok != tc.ok {
+			t.Fatalf("[%s] expected %v, got %v", tc.name, tc.ok, ok)
+		}
+		if ok && !bytes.Equal(adu, tc.msg) {
+			t.Fatalf("[%s] unexpected ADU: % x", tc.name, adu)
+		}
+	}
+}
+
+func TestMatch_Tags(t *testing.T) {
+	m := new(Conn)
+	m.tagLen = 1
+
+	req := []byte{1, 3, 0, 0, 0, 1}
+	m.setPending(req)
+	late := []byte{m.tag, 1, 3, 2, 0, 1}
+	m.setPending(req)
+	if _, ok := m.match(late); ok {
+		t.Fatal("late response accepted")
+	}
+	adu, ok := m.match([]byte{m.tag, 1, 3, 2, 0, 2})
+	if !ok {
+		t.Fatal("response rejected")
+	}
+	if want := []byte{1, 3, 2, 0, 2}; !bytes.Equal(adu, want) {
+		t.Fatalf("unexpected ADU: % x", adu)
+	}
+}
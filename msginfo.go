@@ -0,0 +1,58 @@
+package seg
+
+import (
+	"context"
+	"time"
+)
+
+// MsgInfo contains metadata of a message received.
+type MsgInfo struct {
+	First time.Time // reception time of the first frame
+	Last  time.Time // reception time of the last frame
+
+	// Frames is the number of frames the message took,
+	// including duplicates and retransmissions.
+	Frames int
+
+	// Source is the source of the last frame, see FrameInfo.
+	Source any
+
+	// Discarded is the number of frames that have been read since
+	// the previous message, but did not contribute to this one,
+	// like stray continuation frames, or frames of messages
+	// that have been aborted or rejected.
+	Discarded int
+}
+
+// ReadMsgInfo is like ReadMsgContext, but additionally returns
+// metadata of the message received.
+func (s *Seg) ReadMsgInfo(ctx context.Context) ([]byte, MsgInfo, error) {
+	msg, err := s.ReadMsgContext(ctx)
+	if err != nil {
+		return nil, MsgInfo{}, err
+	}
+	return msg, s.msgInfo, nil
+}
+
+// gotFrame records the metadata of a frame read.
+func (s *Seg) gotFrame(info FrameInfo) {
+	s.frameInfo = info
+	s.nFrames++
+}
+
+// startMsg records the frame last read as the first frame of a message.
+func (s *Seg) startMsg() {
+	s.msgInfo = MsgInfo{
+		First:     s.frameInfo.Time,
+		Discarded: s.nFrames - 1,
+	}
+}
+
+// endMsg records the frame last read as the last frame of a message.
+func (s *Seg) endMsg() {
+	mi := &s.msgInfo
+	mi.Last = s.frameInfo.Time
+	mi.Source = s.frameInfo.Source
+	mi.Frames = s.nFrames - mi.Discarded
+	s.nFrames = 0
+}
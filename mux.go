@@ -0,0 +1,188 @@
+package seg
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// MuxSplitFunc extracts the channel key from a frame read by a Mux,
+// and returns the remaining part of the frame, which is passed to the
+// channel's Seg. If ok is false, the frame is discarded.
+type MuxSplitFunc[K comparable] func(frame []byte) (key K, payload []byte, ok bool)
+
+// Mux reads frames from a single connection and demultiplexes them
+// to channels identified by a key, like a CAN identifier or an address
+// byte, that is derived from each frame by a caller-supplied function.
+// Each channel is served by a Seg with its own reassembly state.
+type Mux[K comparable] struct {
+	conn  FrameConn
+	size  int
+	split MuxSplitFunc[K]
+
+	mu    sync.Mutex
+	chans map[K]*muxChan
+	err   error
+	stats MuxStats
+
+	wmu  sync.Mutex
+	wBuf []byte
+}
+
+// MuxStats contains counters of frames a Mux had to discard.
+type MuxStats struct {
+	Invalid   uint64 // frames rejected by the split function
+	Unknown   uint64 // frames for channels not open
+	Overflow  uint64 // frames dropped because a channel's queue was full
+	Truncated uint64 // frames too large for the size passed to NewMux
+}
+
+// MuxQueueLen is the number of frames that are queued
+// per channel before further frames are dropped.
+var MuxQueueLen = 64
+
+var (
+	ErrMuxChannelOpen = errors.New("seg: mux channel already open")
+	ErrMuxClosed      = errors.New("seg: mux channel closed")
+)
+
+// NewMux creates a Mux reading frames of up to size bytes from conn,
+// which is used like by New. It starts a goroutine reading from conn,
+// which runs until a read returns an error; this error is then returned
+// by the reads of all channels, and by subsequent calls to Open.
+func NewMux[K comparable](conn io.ReadWriter, size int, split MuxSplitFunc[K]) *Mux[K] {
+	m := &Mux[K]{
+		conn:  ReadWriterFrameConn(conn),
+		size:  size,
+		split: split,
+		chans: make(map[K]*muxChan),
+		wBuf:  make([]byte, 0, size),
+	}
+	go m.reader()
+	return m
+}
+
+// Open creates a Seg for the channel identified by key. Frames written
+// by the Seg are prefixed with txPrefix, which should contain the
+// addressing information the peer expects. The frame size of the Seg is
+// the size passed to NewMux, reduced by the length of txPrefix.
+func (m *Mux[K]) Open(key K, txPrefix []byte, name string, opts ...Option) (*Seg, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.chans[key]; ok {
+		return nil, ErrMuxChannelOpen
+	}
+	c := &muxChan{
+		q:      make(chan rxFrame, MuxQueueLen),
+		done:   make(chan struct{}),
+		write:  m.writeFrame,
+		prefix: append([]byte(nil), txPrefix...),
+	}
+	m.chans[key] = c
+	return NewFromFrameConn(c, m.size-len(txPrefix), name, opts...), nil
+}
+
+// Close closes the channel identified by key. Pending and future
+// reads of its Seg return ErrMuxClosed.
+func (m *Mux[K]) Close(key K) {
+	m.mu.Lock()
+	c, ok := m.chans[key]
+	if ok {
+		delete(m.chans, key)
+		close(c.done)
+	}
+	m.mu.Unlock()
+}
+
+// Stats returns a snapshot of the counters.
+func (m *Mux[K]) Stats() MuxStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *Mux[K]) reader() {
+	buf := make([]byte, m.size)
+	for {
+		n, info, err := m.conn.ReadFrame(buf)
+		if err == ErrFrameTruncated {
+			m.mu.Lock()
+			m.stats.Truncated++
+			m.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			m.mu.Lock()
+			m.err = err
+			for _, c := range m.chans {
+				c.err = err
+				close(c.q)
+			}
+			m.chans = nil
+			m.mu.Unlock()
+			return
+		}
+		key, payload, ok := m.split(buf[:n])
+		m.mu.Lock()
+		switch c := m.chans[key]; {
+		case !ok:
+			m.stats.Invalid++
+		case c == nil:
+			m.stats.Unknown++
+		default:
+			select {
+			case c.q <- rxFrame{append([]byte(nil), payload...), info}:
+			default:
+				m.stats.Overflow++
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Mux[K]) writeFrame(prefix, b []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.wBuf = append(append(m.wBuf[:0], prefix...), b...)
+	return m.conn.WriteFrame(m.wBuf)
+}
+
+// muxChan is the connection of a channel's Seg.
+type muxChan struct {
+	q    chan rxFrame
+	done chan struct{}
+	err  error // valid once q is closed
+
+	write  func(prefix, b []byte) error
+	prefix []byte
+}
+
+// ReadFrame returns ErrFrameTruncated for frames with a shorter
+// address prefix than txPrefix, which may not fit into b.
+func (c *muxChan) ReadFrame(b []byte) (int, FrameInfo, error) {
+	select {
+	case f, ok := <-c.q:
+		if !ok {
+			return 0, FrameInfo{}, c.err
+		}
+		n := copy(b, f.b)
+		if n < len(f.b) {
+			return n, f.info, ErrFrameTruncated
+		}
+		return n, f.info, nil
+	case <-c.done:
+		return 0, FrameInfo{}, ErrMuxClosed
+	}
+}
+
+func (c *muxChan) WriteFrame(b []byte) error {
+	select {
+	case <-c.done:
+		return ErrMuxClosed
+	default:
+	}
+	return c.write(c.prefix, b)
+}
@@ -0,0 +1,254 @@
+package seg
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooManyMsgs is reported if a Reassembler discards the least recently
+// active message, because the maximum number of slots has been reached.
+var ErrTooManyMsgs = errors.New("seg: too many messages being reassembled")
+
+// DefaultMaxSlots is the maximum number of slots of a Reassembler,
+// unless changed using SetMaxSlots.
+var DefaultMaxSlots = 64
+
+// Reassembler reads frames from the connection of a Seg, and reassembles
+// multiple messages at the same time, each in its own slot identified by
+// a key, like a transaction or sender tag, that is derived from each frame
+// by a caller-supplied function. Frames of different messages may be
+// interleaved, and continuation frames of a message may arrive out of order.
+//
+// Only header formats announcing frame counts, whose continuation indexes
+// do not wrap around, are supported, not ISO-TP or flow control.
+// Configuration like the header format, checksums, the maximum message
+// size, and the error function is taken from the Seg, which must not
+// be read from otherwise.
+type Reassembler[K comparable] struct {
+	s           *Seg
+	split       MuxSplitFunc[K]
+	slotTimeout time.Duration
+	maxSlots    int
+	slots       map[K]*slot
+}
+
+// slot contains the state of a message being reassembled.
+type slot struct {
+	parts    [][]byte // data of each frame, indexed by frame number
+	nParts   int      // number of parts received
+	complete bool     // start frame received, len(parts) is final
+	size     int
+	lastRecv time.Time
+}
+
+// NewReassembler creates a Reassembler reading from s. Slots that did not
+// receive a frame within slotTimeout are discarded, reporting a *TimeoutError;
+// a value of zero disables the timeout.
+func NewReassembler[K comparable](s *Seg, split MuxSplitFunc[K], slotTimeout time.Duration) *Reassembler[K] {
+	return &Reassembler[K]{
+		s:           s,
+		split:       split,
+		slotTimeout: slotTimeout,
+		maxSlots:    DefaultMaxSlots,
+		slots:       make(map[K]*slot),
+	}
+}
+
+// SetMaxSlots limits the number of messages being reassembled at the same
+// time. If a frame of a new message arrives while all slots are in use,
+// the slot that did not receive a frame for the longest time is discarded,
+// reporting ErrTooManyMsgs. A value of zero means no limit.
+func (r *Reassembler[K]) SetMaxSlots(n int) {
+	r.maxSlots = n
+}
+
+// ReadMsg returns the next complete message, and the key of its slot.
+// The message is owned by the caller.
+func (r *Reassembler[K]) ReadMsg() (K, []byte, error) {
+	return r.ReadMsgContext(context.Background())
+}
+
+// ReadMsgContext is like ReadMsg, but aborts when ctx is done.
+// Slots of messages not yet complete are retained.
+func (r *Reassembler[K]) ReadMsgContext(ctx context.Context) (K, []byte, error) {
+	var none K
+
+	s := r.s
+	for {
+		b, err := s.readFrame(ctx, r.expire())
+		if err == errFrameTimeout {
+			continue
+		}
+		if err != nil {
+			return none, nil, err
+		}
+		s.countStat(&s.stats.FramesReceived)
+		if s.isDuplicate(b) {
+			s.releaseFrame(b)
+			continue
+		}
+
+		key, frame, ok := r.split(b)
+		var hdr Header
+		var h int
+		if ok {
+			hdr, h, ok = s.codec.ParseHeader(frame)
+		}
+		if !ok {
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrEmptyFrame)
+			continue
+		}
+		kind, index, count := hdr.Kind, hdr.Index, hdr.Count
+		if kind == ControlFrame {
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrUnexpectedCont)
+			continue
+		}
+		data := frame[h:]
+		sl := r.slots[key]
+		start := kind == SingleFrame || kind == StartFrame
+		if start && sl != nil && sl.complete {
+			s.recvError(ErrAbortedStart)
+			delete(r.slots, key)
+			sl = nil
+		}
+		if kind == SingleFrame {
+			s.trace("->", "single", b)
+			msg := append([]byte(nil), data...)
+			s.releaseFrame(b)
+			if s.exceedsLimit(len(msg)) {
+				return key, nil, s.rejectMsg(len(msg), false)
+			}
+			s.countStat(&s.stats.MsgsReceived)
+			msg, err = s.checkMsg(msg, 0)
+			return key, msg, err
+		}
+		if start && s.exceedsLimit(count) {
+			// discard continuation frames received before
+			delete(r.slots, key)
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			return key, nil, s.rejectMsg(count, false)
+		}
+
+		i := index
+		if !start && (sl == nil || !sl.complete) && s.exceedsLimit(i+1) {
+			// each frame preceding this one carries at least one byte
+			delete(r.slots, key)
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			return key, nil, s.rejectMsg(i+1, false)
+		}
+		if sl == nil {
+			r.evict()
+			sl = new(slot)
+			r.slots[key] = sl
+		}
+		if start {
+			if len(sl.parts) > count {
+				// continuation frames received so far don't fit
+				delete(r.slots, key)
+				s.trace("->", "??", b)
+				s.releaseFrame(b)
+				s.recvError(ErrSeqGap)
+				continue
+			}
+			sl.complete = true
+			sl.parts = growParts(sl.parts, count)
+		} else if sl.complete && i >= len(sl.parts) {
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrSeqGap)
+			continue
+		}
+		if i >= len(sl.parts) {
+			sl.parts = growParts(sl.parts, i+1)
+		}
+		if sl.parts[i] != nil {
+			// already received
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrSeqGap)
+			continue
+		}
+		if start {
+			s.trace("->", "start", b)
+		} else {
+			s.trace("->", "cont", b)
+		}
+		sl.parts[i] = append(make([]byte, 0, len(data)), data...)
+		sl.nParts++
+		sl.size += len(data)
+		sl.lastRecv = time.Now()
+		s.releaseFrame(b)
+		if s.exceedsLimit(sl.size) {
+			delete(r.slots, key)
+			return key, nil, s.rejectMsg(sl.size, false)
+		}
+		if !sl.complete || sl.nParts != len(sl.parts) {
+			continue
+		}
+
+		delete(r.slots, key)
+		msg := make([]byte, 0, sl.size)
+		for _, p := range sl.parts {
+			msg = append(msg, p...)
+		}
+		s.countStat(&s.stats.MsgsReceived)
+		msg, err = s.checkMsg(msg, 0)
+		return key, msg, err
+	}
+}
+
+// Pending returns the number of messages being reassembled.
+func (r *Reassembler[K]) Pending() int {
+	return len(r.slots)
+}
+
+// expire discards slots that timed out, and returns the time until
+// the next of the remaining slots times out, or zero if none may.
+func (r *Reassembler[K]) expire() (next time.Duration) {
+	if r.slotTimeout == 0 {
+		return 0
+	}
+	now := time.Now()
+	for key, sl := range r.slots {
+		d := r.slotTimeout - now.Sub(sl.lastRecv)
+		if d > 0 {
+			if next == 0 || d < next {
+				next = d
+			}
+			continue
+		}
+		delete(r.slots, key)
+		r.s.recvError(&TimeoutError{Received: sl.nParts, Expected: len(sl.parts)})
+	}
+	return next
+}
+
+// evict discards the least recently active slot if all slots are in use.
+func (r *Reassembler[K]) evict() {
+	if r.maxSlots <= 0 || len(r.slots) < r.maxSlots {
+		return
+	}
+	var oldest K
+	var t time.Time
+	for key, sl := range r.slots {
+		if t.IsZero() || sl.lastRecv.Before(t) {
+			oldest, t = key, sl.lastRecv
+		}
+	}
+	delete(r.slots, oldest)
+	r.s.recvError(ErrTooManyMsgs)
+}
+
+func growParts(parts [][]byte, n int) [][]byte {
+	if n <= len(parts) {
+		return parts
+	}
+	return append(parts, make([][]byte, n-len(parts))...)
+}
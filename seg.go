@@ -1,13 +1,33 @@
 package seg
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"iter"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var DefaultWriteDelay time.Duration = 0
 
+// ErrTooManyFrames is returned by Write if the message would need more frames
+// than the header format is able to represent.
+var ErrTooManyFrames = errors.New("seg: message exceeds maximum frame count")
+
+// Errors detected during reassembly. ReadMsg does not return them,
+// but skips the offending frames; they are passed to the function
+// registered using WithErrorFunc, and counted in Stats.
+var (
+	ErrUnexpectedCont = errors.New("seg: unexpected continuation frame")
+	ErrSeqGap         = errors.New("seg: continuation frame out of sequence")
+	ErrAbortedStart   = errors.New("seg: message aborted by a new start frame")
+	ErrEmptyFrame     = errors.New("seg: frame too short")
+)
+
 // Strategy returns the total frame count n and an iterator yielding the data capacity for each frame.
 type Strategy func(msgLen int) (nFrames int, seq iter.Seq[int])
 
@@ -20,21 +40,112 @@ func WithStrategy(st Strategy) Option {
 	}
 }
 
-// defaultStrategy creates a uniform greedy strategy based on max frame capacity (segSize - 1 control byte).
-func defaultStrategy(segSize int) Strategy {
-	maxCap := max(segSize-1, 1)
+// WithExtendedHeader selects the extended header format, which uses two bytes
+// per frame instead of one: the start bit, followed by a 15-bit frame count
+// or continuation index. This allows messages of up to 32768 frames,
+// whereas the classic format is limited to 128 frames.
+// Both peers must use the same format.
+//
+// A custom strategy must account for the additional header byte,
+// see CANFDStrategyExt.
+func WithExtendedHeader() Option {
+	return WithCodec(ExtendedCodec{})
+}
+
+// WithCodec selects the header format. Both peers must use the same
+// format. A custom strategy must account for the header lengths.
+func WithCodec(c Codec) Option {
+	return func(s *Seg) {
+		s.codec = c
+	}
+}
+
+// WithInterFrameTimeout sets the maximum time ReadMsgContext waits for the
+// next continuation frame of a multi-frame message. If it expires, reassembly
+// is aborted and a *TimeoutError is returned. A value of zero,
+// which is the default, disables the timeout.
+func WithInterFrameTimeout(d time.Duration) Option {
+	return func(s *Seg) {
+		s.interFrameTimeout = d
+	}
+}
+
+// WithErrorFunc registers a function that is called for each error
+// detected during reassembly, i.e. one of the ErrUnexpectedCont,
+// ErrSeqGap, ErrAbortedStart, ErrEmptyFrame, ErrFrameTruncated values,
+// a *TimeoutError, a *ChecksumError, or a *MsgSizeError; the latter
+// three are also returned by ReadMsg.
+// It is called from within ReadMsg, or from the goroutine reading
+// frames in the background, and should not block.
+func WithErrorFunc(f func(err error)) Option {
+	return func(s *Seg) {
+		s.errFunc = f
+	}
+}
+
+// WithWriteDelay sets the delay between frames of a multi-frame message.
+// It overrides DefaultWriteDelay.
+func WithWriteDelay(d time.Duration) Option {
+	return func(s *Seg) {
+		s.writeDelay.Store(int64(d))
+	}
+}
+
+// WithMaxMsgSize limits the size of messages accepted by ReadMsg.
+// Start frames announcing a message that is certainly larger are
+// rejected, and reassembly is aborted as soon as the limit is exceeded;
+// in both cases a *MsgSizeError is returned. In flow control mode,
+// the sender is notified about a rejected message.
+func WithMaxMsgSize(n int) Option {
+	return func(s *Seg) {
+		s.maxMsgSize = n
+	}
+}
+
+// WithDuplicateTolerance makes ReadMsg ignore a frame that is an exact
+// repetition of the previous frame, as delivered by some CAN adapters
+// and bridges, if it is received within the specified time window;
+// if the window is not positive, DefaultDuplicateWindow is used.
+// Only a single repetition is ignored. Since frames of a multi-frame
+// message differ in their headers, only start and single frames may be
+// affected; identical single-frame messages sent in quick succession
+// cannot be distinguished from duplicates.
+func WithDuplicateTolerance(window time.Duration) Option {
+	return func(s *Seg) {
+		if window <= 0 {
+			window = DefaultDuplicateWindow
+		}
+		s.dupWindow = window
+	}
+}
+
+// DefaultDuplicateWindow is the time window of WithDuplicateTolerance,
+// if none is specified.
+var DefaultDuplicateWindow = 10 * time.Millisecond
+
+// defaultStrategy creates a greedy strategy filling each frame up to segSize,
+// taking into account the header lengths of the codec.
+func defaultStrategy(segSize int, c Codec) Strategy {
+	contCap := max(segSize-c.HeaderLen(Header{Kind: ContFrame}), 1)
 
 	return func(msgLen int) (int, iter.Seq[int]) {
-		nFrames := (msgLen + maxCap - 1) / maxCap
+		maxCap := segSize - c.HeaderLen(Header{Kind: SingleFrame, Count: 1, Len: msgLen})
+		nFrames := 1
+		if msgLen > maxCap {
+			maxCap = max(segSize-c.HeaderLen(Header{Kind: StartFrame, Len: msgLen}), 1)
+			nFrames += (msgLen - maxCap + contCap - 1) / contCap
+		}
 
 		seq := func(yield func(int) bool) {
 			rem := msgLen
+			frameCap := maxCap
 			for rem > 0 {
-				cap := min(rem, maxCap)
+				cap := min(rem, frameCap)
 				if !yield(cap) {
 					return
 				}
 				rem -= cap
+				frameCap = contCap
 			}
 		}
 
@@ -42,97 +153,488 @@ func defaultStrategy(segSize int) Strategy {
 	}
 }
 
+// Seg splits messages into frames written to an underlying
+// datagram connection, and reassembles messages from frames read from it.
+//
+// Multiple goroutines may call Write simultaneously; the frames of
+// one message are written without being interleaved with frames of
+// other messages. Reading must be done by a single goroutine,
+// which may run concurrently with writers. SetWriteDelay, WriteDelay,
+// PrevWriteMultiple, SetLenCheck and Stats may be called at any time.
+// Tracef must be set before the Seg is used.
 type Seg struct {
-	conn io.ReadWriter
+	conn FrameConn
 	name string
 	rMsg []byte
 	rBuf []byte
-	nErr int
 	wBuf []byte
+	wMsg []byte
 
+	codec    Codec
+	txTag    int // tag of the message written last
 	strategy Strategy
+	checksum *checksum
+	fc       *flowControl
+	sr       *selectiveRepeat
+	isotp    *ISOTPConfig
+
+	interFrameTimeout time.Duration
+	errFunc           func(err error)
+	maxMsgSize        int
 
-	PrevWriteMultiple bool
-	WriteDelay        time.Duration
-	Tracef            func(format string, a ...any)
+	dupWindow     time.Duration // < 0: disabled
+	lastFrame     []byte
+	lastFrameTime time.Time
+
+	frameInfo FrameInfo // of the frame last returned by readFrame
+	nFrames   int       // frames read since the previous message
+	msgInfo   MsgInfo
+
+	lenCheck  atomic.Pointer[LenCheck]
+	skipConts bool // skip continuation frames of a rejected message
+
+	statsMu sync.Mutex
+	stats   Stats
+
+	// used once frames are read by a separate goroutine
+	frameC  chan rxFrame
+	freeC   chan []byte
+	readErr error
+
+	wmu               sync.Mutex // serializes writes of messages
+	fmu               sync.Mutex // serializes writes of frames
+	writeDelay        atomic.Int64
+	prevWriteMultiple atomic.Bool
+
+	Tracef func(format string, a ...any)
 }
 
+// New creates a Seg transferring frames of up to size bytes over conn,
+// which must preserve frame boundaries, see ReadWriterFrameConn.
+// If conn implements FrameConn, it is used as such.
 func New(conn io.ReadWriter, size int, name string, opts ...Option) *Seg {
+	return NewFromFrameConn(ReadWriterFrameConn(conn), size, name, opts...)
+}
+
+// NewFromFrameConn creates a Seg transferring frames
+// of up to size bytes over conn.
+func NewFromFrameConn(conn FrameConn, size int, name string, opts ...Option) *Seg {
 	s := &Seg{
-		conn:       conn,
-		name:       name,
-		rBuf:       make([]byte, size),
-		wBuf:       make([]byte, size),
-		strategy:   defaultStrategy(size),
-		WriteDelay: DefaultWriteDelay,
+		conn:      conn,
+		name:      name,
+		rBuf:      make([]byte, size),
+		wBuf:      make([]byte, size),
+		codec:     ClassicCodec{},
+		dupWindow: -1,
 	}
+	s.writeDelay.Store(int64(DefaultWriteDelay))
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.isotp != nil {
+		s.codec = ISOTPCodec{}
+		s.strategy = nil
+		s.conn = &isotpPadConn{FrameConn: conn, cfg: *s.isotp, buf: make([]byte, size)}
+		if s.fc == nil {
+			// flow control is an integral part of ISO-TP
+			WithFlowControl(FlowControl{})(s)
+		}
+	}
+	if s.strategy == nil {
+		s.strategy = defaultStrategy(size, s.codec)
+	}
+	if s.fc != nil {
+		// selective repeat cannot be combined
+		s.sr = nil
+	}
+	if s.fc != nil || s.sr != nil {
+		s.startReader()
+	}
 	return s
 }
 
-const startBit byte = 1 << 7
-
 const (
 	expectStartOrSingle = iota
 	expectContinuation
 )
 
+// TimeoutError is returned by ReadMsgContext if a continuation frame
+// did not arrive within the inter-frame timeout.
+type TimeoutError struct {
+	Received int // number of frames received
+	Expected int // number of frames announced by the start frame
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("seg: inter-frame timeout after %d of %d frames", e.Received, e.Expected)
+}
+
+// Timeout returns true, making TimeoutError match
+// the Timeout method of net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// MsgSizeError is returned by ReadMsg if a message
+// exceeds the limit set using WithMaxMsgSize.
+type MsgSizeError struct {
+	Limit int
+	Size  int // minimum size of the message, as far as known
+}
+
+func (e *MsgSizeError) Error() string {
+	return fmt.Sprintf("seg: message size of at least %d bytes exceeds limit of %d", e.Size, e.Limit)
+}
+
+// exceedsLimit reports whether a message of n bytes, possibly
+// including a checksum, exceeds the configured maximum size.
+func (s *Seg) exceedsLimit(n int) bool {
+	if s.maxMsgSize <= 0 {
+		return false
+	}
+	if s.checksum != nil {
+		n -= s.checksum.size
+	}
+	return n > s.maxMsgSize
+}
+
+// rejectMsg returns a *MsgSizeError for a message of at least n bytes,
+// after reporting it. If more frames of the message are to be expected,
+// they are skipped, and the sender is notified in flow control mode.
+func (s *Seg) rejectMsg(n int, more bool) error {
+	if s.checksum != nil {
+		n = max(n-s.checksum.size, 0)
+	}
+	err := &MsgSizeError{Limit: s.maxMsgSize, Size: n}
+	s.recvError(err)
+	if more {
+		s.skipConts = true
+		if s.sr != nil {
+			s.sr.skipConts = true
+		}
+		if fcErr := s.notifyOverflow(); fcErr != nil {
+			return fcErr
+		}
+	}
+	return err
+}
+
+// ReadMsg reads frames from the underlying connection until a complete
+// message has been reassembled. It is equivalent to ReadMsgContext
+// with a background context.
+//
+// The message returned is stored in a buffer owned by the Seg,
+// which is overwritten by the next call; see AppendMsg
+// and ReadMsgInto for alternatives.
 func (s *Seg) ReadMsg() ([]byte, error) {
-	var iCont, nCont byte
+	return s.ReadMsgContext(context.Background())
+}
+
+// ReadMsgContext is like ReadMsg, but aborts when ctx is done,
+// returning ctx.Err(), or when the inter-frame timeout, if configured,
+// expires. A partially received message is discarded;
+// the next call starts with a fresh reassembly state.
+//
+// Since a Read on the underlying connection cannot be interrupted,
+// the first call that may need to abort starts a goroutine that reads
+// frames in the background; it runs until the connection's Read
+// returns an error.
+func (s *Seg) ReadMsgContext(ctx context.Context) ([]byte, error) {
+	msg, err := s.AppendMsgContext(ctx, s.rMsg[:0])
+	s.rMsg = msg
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ReadMsgInto reads the next message into dst, returning the number of
+// bytes stored. If dst is too small, the message is truncated,
+// and io.ErrShortBuffer is returned.
+func (s *Seg) ReadMsgInto(dst []byte) (n int, err error) {
+	// limit the capacity, so that bytes beyond len(dst) are not modified
+	msg, err := s.AppendMsg(dst[:0:len(dst)])
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(dst) {
+		return copy(dst, msg), io.ErrShortBuffer
+	}
+	return len(msg), nil
+}
+
+// AppendMsg reads the next message like ReadMsg, appends it to dst,
+// and returns the extended buffer. In case of an error, dst is
+// returned unmodified. As long as dst has sufficient capacity,
+// and neither a context nor an inter-frame timeout is involved,
+// no allocations are made.
+func (s *Seg) AppendMsg(dst []byte) ([]byte, error) {
+	return s.AppendMsgContext(context.Background(), dst)
+}
 
-	s.rMsg = s.rMsg[:0]
+// AppendMsgContext is like AppendMsg, but aborts like ReadMsgContext.
+func (s *Seg) AppendMsgContext(ctx context.Context, dst []byte) ([]byte, error) {
+	if s.sr != nil {
+		return s.appendMsgSR(ctx, dst)
+	}
+
+	var iCont, nCont, msgLen, contCap, tag int
+
+	off := len(dst)
 	state := expectStartOrSingle
-	b := s.rBuf
 	for {
-		n, err := s.conn.Read(b)
+		var timeout time.Duration
+		if state == expectContinuation {
+			timeout = s.interFrameTimeout
+		}
+		b, err := s.readFrame(ctx, timeout)
 		if err != nil {
-			return nil, err
+			if err == errFrameTimeout {
+				expected := nCont + 1
+				if msgLen != 0 {
+					expected = iCont + (msgLen-len(dst[off:])+contCap-1)/contCap
+				}
+				err = &TimeoutError{Received: iCont, Expected: expected}
+				s.recvError(err)
+			}
+			return dst[:off], err
+		}
+		s.countStat(&s.stats.FramesReceived)
+		if s.isDuplicate(b) {
+			s.releaseFrame(b)
+			continue
 		}
-		if n < 1 {
-			s.trace("->", "??", []byte{})
+		hdr, h, ok := s.codec.ParseHeader(b)
+		if !ok {
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			dst = dst[:off]
 			state = expectStartOrSingle
-			s.nErr++
+			s.recvError(ErrEmptyFrame)
 			continue
 		}
-		c := b[0]
-		frame := b[:n]
-		switch state {
-		case expectStartOrSingle:
-			if c & ^startBit == 0 {
+		if state == expectContinuation {
+			switch {
+			case hdr.Kind == SingleFrame || hdr.Kind == StartFrame:
+				// the previous message has been aborted,
+				// handle b as a new start frame below
+				s.recvError(ErrAbortedStart)
+				dst = dst[:off]
+				state = expectStartOrSingle
+			case hdr.Kind != ContFrame || hdr.Index != s.contIndex(iCont) || hdr.Tag != tag:
+				dst = dst[:off]
+				state = expectStartOrSingle
+				s.trace("->", "??", b)
+				s.releaseFrame(b)
+				s.recvError(ErrSeqGap)
+				continue
+			default:
+				s.trace("->", "cont", b)
+			}
+		}
+		data := b[h:]
+		if state == expectStartOrSingle {
+			if hdr.Kind == SingleFrame {
 				// single message
-				s.trace("->", "single", frame)
-				return b[1:n], nil
+				s.trace("->", "single", b)
+				s.startMsg()
+				if hdr.Len != 0 {
+					data = data[:min(hdr.Len, len(data))]
+				}
+				dst = append(dst, data...)
+				s.releaseFrame(b)
+				if s.exceedsLimit(len(dst) - off) {
+					return dst[:off], s.rejectMsg(len(dst)-off, false)
+				}
+				s.countStat(&s.stats.MsgsReceived)
+				return s.checkMsg(dst, off)
 			}
-			if c&startBit == 0 {
+			if hdr.Kind == ContFrame && s.skipConts {
+				// remainder of a message rejected by the length check
+				s.trace("->", "skip", b)
+				s.releaseFrame(b)
+				continue
+			}
+			s.skipConts = false
+			if hdr.Kind != StartFrame {
 				// no start frame, skip
-				s.nErr++
-				s.trace("->", "??", frame)
+				s.trace("->", "??", b)
+				s.releaseFrame(b)
+				s.recvError(ErrUnexpectedCont)
 				continue
 			}
+			size := hdr.Len
+			if size == 0 {
+				// with one byte per frame at least
+				size = hdr.Count
+			}
+			if s.exceedsLimit(size) {
+				s.trace("->", "??", b)
+				s.releaseFrame(b)
+				return dst[:off], s.rejectMsg(size, true)
+			}
 			state = expectContinuation
+			s.startMsg()
 			iCont = 0
-			nCont = c ^ startBit
-			s.trace("->", "start", frame)
-
-		case expectContinuation:
-			if c&startBit != 0 || c != iCont {
-				state = expectStartOrSingle
-				s.nErr++
-				s.trace("->", "??", frame)
-				continue
-			}
-			s.trace("->", "cont", frame)
+			nCont = hdr.Count - 1
+			msgLen = hdr.Len
+			contCap = max(len(b)-s.codec.HeaderLen(Header{Kind: ContFrame}), 1)
+			tag = hdr.Tag
+			s.trace("->", "start", b)
+		}
+		if msgLen != 0 {
+			data = data[:min(len(data), msgLen-len(dst[off:]))]
 		}
-		s.rMsg = append(s.rMsg, b[1:n]...)
-		if iCont == nCont {
+		dst = append(dst, data...)
+		s.releaseFrame(b)
+		n := len(dst) - off
+		complete := iCont == nCont
+		if msgLen != 0 {
+			complete = n == msgLen
+		}
+		if s.exceedsLimit(n) {
+			return dst[:off], s.rejectMsg(n, !complete)
+		}
+		if complete {
 			break
 		}
+		lo, hi := msgLen, msgLen
+		if msgLen == 0 {
+			rem := nCont - iCont
+			lo, hi = n+rem, n+rem*(len(s.rBuf)-s.codec.HeaderLen(Header{Kind: ContFrame}))
+		}
+		err = s.checkLen(dst[off:], lo, hi)
+		if err != nil {
+			return dst[:off], err
+		}
+		if s.fc != nil && s.fc.needFC(iCont) {
+			err = s.sendFC(fcContinue)
+			if err != nil {
+				return dst[:off], err
+			}
+		}
 		iCont++
 	}
-	return s.rMsg, nil
+	s.countStat(&s.stats.MsgsReceived)
+	return s.checkMsg(dst, off)
+}
+
+// contIndex returns the index expected in the header
+// of continuation frame i, as decoded by the codec.
+func (s *Seg) contIndex(i int) int {
+	if m := s.codec.IndexMod(); m != 0 {
+		return i % m
+	}
+	return i
+}
+
+var errFrameTimeout = errors.New("seg: frame timeout")
+
+// isDuplicate reports whether b repeats the previous frame
+// within the duplicate tolerance window.
+func (s *Seg) isDuplicate(b []byte) bool {
+	if s.dupWindow < 0 || len(b) == 0 {
+		return false
+	}
+	now := time.Now()
+	if bytes.Equal(b, s.lastFrame) && now.Sub(s.lastFrameTime) <= s.dupWindow {
+		s.trace("->", "dup", b)
+		s.countStat(&s.stats.Duplicates)
+		// a further repetition is regarded a new frame
+		s.lastFrame = s.lastFrame[:0]
+		return true
+	}
+	s.lastFrame = append(s.lastFrame[:0], b...)
+	s.lastFrameTime = now
+	return false
+}
+
+// readFrame returns the next frame received from the connection.
+// As long as neither a cancelable context nor a timeout is involved,
+// frames are read directly into s.rBuf. Otherwise a reader goroutine
+// is started, which is used from then on. Frames returned must be
+// passed to releaseFrame once they are not needed anymore.
+func (s *Seg) readFrame(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if s.frameC == nil {
+		if ctx.Done() == nil && timeout == 0 {
+			n, info, err := s.read(s.rBuf)
+			if err != nil {
+				return nil, err
+			}
+			s.gotFrame(info)
+			return s.rBuf[:n], nil
+		}
+		s.startReader()
+	}
+
+	var timeoutC <-chan time.Time
+	if timeout != 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timeoutC = t.C
+	}
+	select {
+	case f, ok := <-s.frameC:
+		if !ok {
+			return nil, s.readErr
+		}
+		s.gotFrame(f.info)
+		return f.b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeoutC:
+		return nil, errFrameTimeout
+	}
+}
+
+// rxFrame is a frame passed on by the reader goroutine.
+type rxFrame struct {
+	b    []byte
+	info FrameInfo
+}
+
+func (s *Seg) startReader() {
+	s.frameC = make(chan rxFrame)
+	s.freeC = make(chan []byte, 2)
+	s.freeC <- s.rBuf
+	s.freeC <- make([]byte, len(s.rBuf))
+	go s.reader()
+}
+
+func (s *Seg) reader() {
+	for b := range s.freeC {
+		n, info, err := s.read(b)
+		if err != nil {
+			s.readErr = err
+			close(s.frameC)
+			return
+		}
+		if s.fc != nil && s.dispatchFC(b[:n]) || s.sr != nil && s.dispatchAck(b[:n]) {
+			s.freeC <- b
+			continue
+		}
+		s.frameC <- rxFrame{b[:n], info}
+	}
+}
+
+// read reads the next frame into b, skipping truncated frames.
+func (s *Seg) read(b []byte) (int, FrameInfo, error) {
+	for {
+		n, info, err := s.conn.ReadFrame(b)
+		if err == ErrFrameTruncated {
+			s.trace("->", "??", b[:n])
+			s.recvError(err)
+			continue
+		}
+		return n, info, err
+	}
+}
+
+func (s *Seg) releaseFrame(b []byte) {
+	if s.freeC != nil {
+		s.freeC <- b[:cap(b)]
+	}
 }
 
 func (s *Seg) Write(msg []byte) (nMsg int, err error) {
@@ -140,46 +642,126 @@ func (s *Seg) Write(msg []byte) (nMsg int, err error) {
 		return 0, nil
 	}
 
-	totalFrames, seq := s.strategy(len(msg))
-	s.PrevWriteMultiple = totalFrames > 1
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	data := msg
+	pre := 0 // length of a prefix preceding msg within data
+	if s.checksum != nil || s.sr != nil {
+		b := s.wMsg[:0]
+		if s.sr != nil {
+			s.sr.txSeq++
+			b = append(b, s.sr.txSeq)
+			pre = 1
+		}
+		b = append(b, msg...)
+		if c := s.checksum; c != nil {
+			b = c.appendSum(b, msg)
+		}
+		s.wMsg = b
+		data = b
+	}
+
+	totalFrames, seq := s.strategy(len(data))
+	if m := s.codec.MaxFrames(); m != 0 && totalFrames > m {
+		return 0, ErrTooManyFrames
+	}
+	s.prevWriteMultiple.Store(totalFrames > 1)
+	if s.fc != nil {
+		s.discardFC()
+	}
+	if s.sr != nil {
+		s.discardAck()
+		s.sr.offs = s.sr.offs[:0]
+	}
+	s.txTag++
 
 	msgPos := 0
 	i := 0
+	p := contPacer{s: s, nFrames: totalFrames}
 	for dataCap := range seq {
-		frameLen := dataCap + 1
-		b := s.wBuf[:frameLen]
+		hdr := s.frameHeader(i, totalFrames, len(data))
+		h := s.codec.HeaderLen(hdr)
+		b := s.wBuf[:h+dataCap]
 
-		var event string
+		s.codec.PutHeader(b, hdr)
+		event := "cont"
 		if totalFrames == 1 {
-			b[0] = startBit
 			event = "single"
 		} else if i == 0 {
-			b[0] = byte(totalFrames-1) | startBit
 			event = "start"
-		} else {
-			b[0] = byte(i)
-			event = "cont"
 		}
 
-		copy(b[1:], msg[msgPos:msgPos+dataCap])
-		_, err = s.conn.Write(b)
+		if i > 0 {
+			err = p.wait()
+			if err != nil {
+				return nMsg, err
+			}
+		}
+
+		copy(b[h:], data[msgPos:msgPos+dataCap])
+		err = s.writeFrame(b)
 		s.trace("<-", event, b)
 		if err != nil {
 			return nMsg, err
 		}
+		s.countStat(&s.stats.FramesSent)
 
-		msgPos += dataCap
-		nMsg += dataCap
-
-		if s.WriteDelay != 0 && i < totalFrames-1 {
-			time.Sleep(s.WriteDelay)
+		if s.sr != nil {
+			s.sr.offs = append(s.sr.offs, msgPos)
 		}
+		msgPos += dataCap
+		nMsg = min(max(msgPos-pre, 0), len(msg))
 		i++
 	}
+	if s.sr != nil && totalFrames > 1 {
+		s.sr.offs = append(s.sr.offs, msgPos)
+		err = s.confirm(data)
+		if err != nil {
+			return nMsg, err
+		}
+	}
+	s.countStat(&s.stats.MsgsSent)
 
 	return nMsg, nil
 }
 
+// frameHeader returns the header of frame i of the message
+// being written, which consists of n frames and msgLen bytes.
+func (s *Seg) frameHeader(i, n, msgLen int) Header {
+	switch {
+	case n == 1:
+		return Header{Kind: SingleFrame, Count: 1, Len: msgLen, Tag: s.txTag}
+	case i == 0:
+		return Header{Kind: StartFrame, Count: n, Len: msgLen, Tag: s.txTag}
+	}
+	return Header{Kind: ContFrame, Index: i, Tag: s.txTag}
+}
+
+func (s *Seg) writeFrame(b []byte) error {
+	s.fmu.Lock()
+	err := s.conn.WriteFrame(b)
+	s.fmu.Unlock()
+	return err
+}
+
+// WriteDelay returns the delay between frames of a multi-frame message.
+func (s *Seg) WriteDelay() time.Duration {
+	return time.Duration(s.writeDelay.Load())
+}
+
+// SetWriteDelay sets the delay between frames of a multi-frame message.
+// It takes effect for the next frame written.
+func (s *Seg) SetWriteDelay(d time.Duration) {
+	s.writeDelay.Store(int64(d))
+}
+
+// PrevWriteMultiple reports whether the most recent
+// call to Write resulted in more than one frame.
+func (s *Seg) PrevWriteMultiple() bool {
+	return s.prevWriteMultiple.Load()
+}
+
 func (s *Seg) trace(dir, event string, frame []byte) {
 	if s.Tracef == nil {
 		return
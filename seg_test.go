@@ -2,9 +2,16 @@ package seg_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/knieriem/seg" // Replace with your actual package import path
 )
@@ -132,3 +139,1792 @@ func TestCANFDStrategy_AllLengths(t *testing.T) {
 		}
 	}
 }
+
+// TestExtendedHeader_LongMessages tests messages needing more than
+// 128 frames using the extended header format, with both the default
+// and the CAN FD strategy.
+func TestExtendedHeader_LongMessages(t *testing.T) {
+	const maxLen = 5000
+	masterPayload := generateTestBuffer(maxLen)
+
+	cases := []struct {
+		name    string
+		segSize int
+		opts    []seg.Option
+	}{
+		{"CAN", 8, []seg.Option{seg.WithExtendedHeader()}},
+		{"FD", 64, []seg.Option{seg.WithExtendedHeader(), seg.WithStrategy(seg.CANFDStrategyExt(64))}},
+	}
+	for _, tc := range cases {
+		for _, msgLen := range []int{1, 5, 6, 7, 62, 63, 127 * 6, 128 * 6, 128*6 + 1, 1000, 4321, maxLen} {
+			original := masterPayload[:msgLen]
+
+			pipe := newPacketPipe(1000)
+			sender := seg.New(pipe, tc.segSize, "sender", tc.opts...)
+			receiver := seg.New(pipe, tc.segSize, "receiver", tc.opts...)
+
+			nWritten, err := sender.Write(original)
+			if err != nil {
+				t.Fatalf("[%s Len %d] Write failed: %v", tc.name, msgLen, err)
+			}
+			if nWritten != len(original) {
+				t.Fatalf("[%s Len %d] Expected %d bytes written, got %d", tc.name, msgLen, len(original), nWritten)
+			}
+			received, err := receiver.ReadMsg()
+			if err != nil {
+				t.Fatalf("[%s Len %d] ReadMsg failed: %v", tc.name, msgLen, err)
+			}
+			if !bytes.Equal(original, received) {
+				t.Fatalf("[%s Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", tc.name, msgLen, len(received), len(original))
+			}
+		}
+	}
+}
+
+// TestClassicHeader_TooManyFrames verifies that Write refuses messages
+// the classic header format cannot represent.
+func TestClassicHeader_TooManyFrames(t *testing.T) {
+	pipe := newPacketPipe(200)
+	sender := seg.New(pipe, 8, "sender")
+
+	// 128 frames of 7 bytes is the maximum
+	_, err := sender.Write(generateTestBuffer(128 * 7))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n := len(pipe.packets); n != 128 {
+		t.Fatalf("Expected 128 frames, got %d", n)
+	}
+
+	n, err := sender.Write(generateTestBuffer(128*7 + 1))
+	if err != seg.ErrTooManyFrames {
+		t.Fatalf("Expected ErrTooManyFrames, got %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected 0 bytes written, got %d", n)
+	}
+	if n := len(pipe.packets); n != 128 {
+		t.Fatalf("Expected no additional frames, got %d", n-128)
+	}
+}
+
+// TestReadMsgContext_Cancel verifies that ReadMsgContext returns when the
+// context is done, and that reception continues normally afterwards.
+func TestReadMsgContext_Cancel(t *testing.T) {
+	pipe := newPacketPipe(10)
+	receiver := seg.New(pipe, 8, "receiver")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// start frame announcing one continuation, which never arrives
+	pipe.Write([]byte{0x81, 1, 2, 3, 4, 5, 6, 7})
+	_, err := receiver.ReadMsgContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// orphan continuation of the aborted message, followed by a single frame
+	pipe.Write([]byte{0x01, 8, 9})
+	pipe.Write([]byte{0x80, 10, 11})
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, []byte{10, 11}) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+}
+
+// TestReadMsgContext_InterFrameTimeout verifies that reassembly is aborted
+// with a *TimeoutError if continuation frames stop arriving.
+func TestReadMsgContext_InterFrameTimeout(t *testing.T) {
+	pipe := newPacketPipe(10)
+	sender := seg.New(pipe, 8, "sender")
+	receiver := seg.New(pipe, 8, "receiver", seg.WithInterFrameTimeout(20*time.Millisecond))
+
+	// start frame and first continuation of a three-frame message
+	pipe.Write([]byte{0x82, 1, 2, 3, 4, 5, 6, 7})
+	pipe.Write([]byte{0x01, 8, 9, 10, 11, 12, 13, 14})
+	_, err := receiver.ReadMsg()
+	var te *seg.TimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("Expected *seg.TimeoutError, got %v", err)
+	}
+	if te.Received != 2 || te.Expected != 3 {
+		t.Fatalf("Unexpected frame counts in %v", err)
+	}
+	if !te.Timeout() {
+		t.Fatal("Timeout() returned false")
+	}
+	if n := receiver.Stats().Timeouts; n != 1 {
+		t.Fatalf("Expected one timeout in stats, got %d", n)
+	}
+
+	original := generateTestBuffer(30)
+	if _, err := sender.Write(original); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	received, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(original, received) {
+		t.Fatalf("payload mismatch: % x", received)
+	}
+}
+
+// TestReadMsg_Errors feeds a sequence of invalid frames to ReadMsg and checks
+// the errors reported to the error function, and the statistics.
+func TestReadMsg_Errors(t *testing.T) {
+	pipe := newPacketPipe(20)
+	var errs []error
+	receiver := seg.New(pipe, 8, "receiver", seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	frames := [][]byte{
+		{0x01, 1, 2},       // orphan continuation
+		{},                 // empty frame
+		{0x82, 1, 2},       // start of a three-frame message
+		{0x02, 3, 4},       // index 1 missing
+		{0x81, 5, 6},       // start of a two-frame message
+		{0x81, 7, 8},       // start of another two-frame message
+		{0x01, 9, 10},      // its continuation
+		{0x80, 11, 12, 13}, // single frame
+	}
+	for _, f := range frames {
+		pipe.Write(f)
+	}
+
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, []byte{7, 8, 9, 10}) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+	msg, err = receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, []byte{11, 12, 13}) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+
+	wantErrs := []error{seg.ErrUnexpectedCont, seg.ErrEmptyFrame, seg.ErrSeqGap, seg.ErrAbortedStart}
+	if len(errs) != len(wantErrs) {
+		t.Fatalf("Expected errors %v, got %v", wantErrs, errs)
+	}
+	for i, err := range errs {
+		if err != wantErrs[i] {
+			t.Fatalf("Expected errors %v, got %v", wantErrs, errs)
+		}
+	}
+
+	want := seg.Stats{
+		FramesReceived:  uint64(len(frames)),
+		MsgsReceived:    2,
+		UnexpectedConts: 1,
+		SeqGaps:         1,
+		AbortedStarts:   1,
+		EmptyFrames:     1,
+	}
+	if st := receiver.Stats(); st != want {
+		t.Fatalf("Unexpected stats:\nGot:  %+v\nWant: %+v", st, want)
+	}
+}
+
+// TestStats_Sent checks the counters of frames and messages sent.
+func TestStats_Sent(t *testing.T) {
+	pipe := newPacketPipe(20)
+	sender := seg.New(pipe, 8, "sender")
+
+	sender.Write(generateTestBuffer(7))
+	sender.Write(generateTestBuffer(15))
+
+	want := seg.Stats{FramesSent: 4, MsgsSent: 2}
+	if st := sender.Stats(); st != want {
+		t.Fatalf("Unexpected stats:\nGot:  %+v\nWant: %+v", st, want)
+	}
+}
+
+// TestConcurrentWriters runs several writers and a reader on the same Seg
+// pair, while tunables and statistics are accessed from yet another
+// goroutine. Messages must arrive intact, i.e. frames of different
+// messages must not be interleaved. Run with -race.
+func TestConcurrentWriters(t *testing.T) {
+	const (
+		nWriters = 8
+		nMsgs    = 20
+	)
+	// large enough to never block writers
+	pipe := newPacketPipe(nWriters * nMsgs * 8)
+	sender := seg.New(pipe, 8, "sender")
+	receiver := seg.New(pipe, 8, "receiver")
+
+	// message content is derived from writer and sequence number
+	makeMsg := func(w, i int) []byte {
+		msg := generateTestBuffer(2 + (w*nMsgs+i)%40)
+		msg[0] = byte(w)
+		msg[1] = byte(i)
+		return msg
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for range nWriters * nMsgs {
+			msg, err := receiver.ReadMsgContext(ctx)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if len(msg) < 2 || !bytes.Equal(msg, makeMsg(int(msg[0]), int(msg[1]))) {
+				readErr <- fmt.Errorf("corrupted message: % x", msg)
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			sender.SetWriteDelay(sender.WriteDelay() ^ time.Microsecond)
+			sender.PrevWriteMultiple()
+			sender.Stats()
+			receiver.Stats()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := range nWriters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range nMsgs {
+				if _, err := sender.Write(makeMsg(w, i)); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+	if st := receiver.Stats(); st.MsgsReceived != nWriters*nMsgs || st.FramesReceived != sender.Stats().FramesSent {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
+
+// TestChecksum_AllLengths tests message transfer with CRC-16 and CRC-32
+// checksums enabled, including corrupted messages.
+func TestChecksum_AllLengths(t *testing.T) {
+	const maxLen = 100
+	masterPayload := generateTestBuffer(maxLen)
+
+	for _, tc := range []struct {
+		name string
+		opt  seg.Option
+	}{
+		{"CRC16", seg.WithCRC16()},
+		{"CRC32", seg.WithCRC32()},
+	} {
+		for msgLen := 1; msgLen <= maxLen; msgLen++ {
+			original := masterPayload[:msgLen]
+
+			pipe := newPacketPipe(50)
+			sender := seg.New(pipe, 8, "sender", tc.opt)
+			receiver := seg.New(pipe, 8, "receiver", tc.opt)
+
+			nWritten, err := sender.Write(original)
+			if err != nil {
+				t.Fatalf("[%s Len %d] Write failed: %v", tc.name, msgLen, err)
+			}
+			if nWritten != len(original) {
+				t.Fatalf("[%s Len %d] Expected %d bytes written, got %d", tc.name, msgLen, len(original), nWritten)
+			}
+			received, err := receiver.ReadMsg()
+			if err != nil {
+				t.Fatalf("[%s Len %d] ReadMsg failed: %v", tc.name, msgLen, err)
+			}
+			if !bytes.Equal(original, received) {
+				t.Fatalf("[%s Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", tc.name, msgLen, len(received), len(original))
+			}
+
+			// corrupt the last data byte of the first frame
+			sender.Write(original)
+			f := <-pipe.packets
+			f[len(f)-1] ^= 0x10
+			pipe.packets <- f
+			for range len(pipe.packets) - 1 {
+				pipe.packets <- <-pipe.packets
+			}
+			_, err = receiver.ReadMsg()
+			var ce *seg.ChecksumError
+			if !errors.As(err, &ce) {
+				t.Fatalf("[%s Len %d] Expected *seg.ChecksumError, got %v", tc.name, msgLen, err)
+			}
+			if n := receiver.Stats().ChecksumErrors; n != 1 {
+				t.Fatalf("[%s Len %d] Expected one checksum error in stats, got %d", tc.name, msgLen, n)
+			}
+		}
+	}
+}
+
+// TestChecksum_Short verifies that a message too short
+// to contain a checksum results in a *ChecksumError.
+func TestChecksum_Short(t *testing.T) {
+	pipe := newPacketPipe(10)
+	receiver := seg.New(pipe, 8, "receiver", seg.WithCRC16())
+
+	pipe.Write([]byte{0x80, 1})
+	_, err := receiver.ReadMsg()
+	var ce *seg.ChecksumError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected *seg.ChecksumError, got %v", err)
+	}
+}
+
+// duplex connects two packetPipes to form one end of a bidirectional link.
+type duplex struct {
+	r, w *packetPipe
+}
+
+func (d *duplex) Read(b []byte) (int, error)  { return d.r.Read(b) }
+func (d *duplex) Write(b []byte) (int, error) { return d.w.Write(b) }
+
+func newDuplexPair(bufferSize int) (a, b *duplex) {
+	p1 := newPacketPipe(bufferSize)
+	p2 := newPacketPipe(bufferSize)
+	return &duplex{r: p1, w: p2}, &duplex{r: p2, w: p1}
+}
+
+// TestFlowControl_AllLengths transfers messages in flow control mode
+// using various block sizes.
+func TestFlowControl_AllLengths(t *testing.T) {
+	const maxLen = 100
+	masterPayload := generateTestBuffer(maxLen)
+
+	for _, fc := range []seg.FlowControl{
+		{BlockSize: 0},
+		{BlockSize: 1},
+		{BlockSize: 3, SepTime: 100 * time.Microsecond},
+	} {
+		bs := fc.BlockSize
+		a, b := newDuplexPair(50)
+		sender := seg.New(a, 8, "sender", seg.WithFlowControl(fc))
+		receiver := seg.New(b, 8, "receiver", seg.WithFlowControl(fc))
+
+		for msgLen := 1; msgLen <= maxLen; msgLen++ {
+			original := masterPayload[:msgLen]
+
+			var wg sync.WaitGroup
+			var received []byte
+			var readErr error
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				received, readErr = receiver.ReadMsg()
+			}()
+
+			nWritten, err := sender.Write(original)
+			if err != nil {
+				t.Fatalf("[BS %d Len %d] Write failed: %v", bs, msgLen, err)
+			}
+			if nWritten != len(original) {
+				t.Fatalf("[BS %d Len %d] Expected %d bytes written, got %d", bs, msgLen, len(original), nWritten)
+			}
+			wg.Wait()
+			if readErr != nil {
+				t.Fatalf("[BS %d Len %d] ReadMsg failed: %v", bs, msgLen, readErr)
+			}
+			if !bytes.Equal(original, received) {
+				t.Fatalf("[BS %d Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", bs, msgLen, len(received), len(original))
+			}
+		}
+	}
+}
+
+// TestFlowControl_Sender checks the sender's reaction on flow control
+// frames that are generated manually.
+func TestFlowControl_Sender(t *testing.T) {
+	msg := generateTestBuffer(20) // three frames
+
+	cases := []struct {
+		name    string
+		fc      [][]byte
+		err     error
+		nFrames int
+	}{
+		{"timeout", nil, seg.ErrFlowControlTimeout, 1},
+		{"overflow", [][]byte{{0, 2, 0, 0}}, seg.ErrFlowControlOverflow, 1},
+		{"invalid", [][]byte{{0, 7, 0, 0}}, seg.ErrFlowControlStatus, 1},
+		{"wait", [][]byte{{0, 1, 0, 0}, {0, 1, 0, 0}, {0, 0, 0, 0}}, nil, 3},
+		{"block", [][]byte{{0, 0, 1, 0}}, seg.ErrFlowControlTimeout, 2},
+	}
+	for _, tc := range cases {
+		a, b := newDuplexPair(10)
+		sender := seg.New(a, 8, "sender", seg.WithFlowControl(seg.FlowControl{Timeout: 50 * time.Millisecond}))
+
+		errC := make(chan error)
+		go func() {
+			_, err := sender.Write(msg)
+			errC <- err
+		}()
+
+		// wait for the start frame, then answer
+		<-b.r.packets
+		for _, f := range tc.fc {
+			b.Write(f)
+			time.Sleep(time.Millisecond)
+		}
+		if err := <-errC; err != tc.err {
+			t.Fatalf("[%s] Expected error %v, got %v", tc.name, tc.err, err)
+		}
+		if n := 1 + len(b.r.packets); n != tc.nFrames {
+			t.Fatalf("[%s] Expected %d frames, got %d", tc.name, tc.nFrames, n)
+		}
+	}
+}
+
+// TestISOTP_AllLengths transfers messages using ISO-TP framing over
+// classic CAN and CAN FD sized frames, including 32-bit lengths.
+func TestISOTP_AllLengths(t *testing.T) {
+	const maxLen = 5000
+	masterPayload := generateTestBuffer(maxLen)
+
+	lengths := []int{4095, 4096, maxLen}
+	for msgLen := 1; msgLen <= 300; msgLen++ {
+		lengths = append(lengths, msgLen)
+	}
+	for _, tc := range []struct {
+		name    string
+		segSize int
+		cfg     seg.ISOTPConfig
+	}{
+		{"CAN", 8, seg.ISOTPConfig{}},
+		{"CAN-pad", 8, seg.ISOTPConfig{Pad: true, PadByte: 0x55}},
+		{"FD", 64, seg.ISOTPConfig{}},
+		{"FD-pad", 64, seg.ISOTPConfig{Pad: true}},
+	} {
+		a, b := newDuplexPair(1000)
+		sender := seg.New(a, tc.segSize, "sender", seg.WithISOTP(tc.cfg))
+		receiver := seg.New(b, tc.segSize, "receiver", seg.WithISOTP(tc.cfg))
+
+		for _, msgLen := range lengths {
+			original := masterPayload[:msgLen]
+
+			var wg sync.WaitGroup
+			var received []byte
+			var readErr error
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				received, readErr = receiver.ReadMsg()
+			}()
+
+			nWritten, err := sender.Write(original)
+			if err != nil {
+				t.Fatalf("[%s Len %d] Write failed: %v", tc.name, msgLen, err)
+			}
+			if nWritten != len(original) {
+				t.Fatalf("[%s Len %d] Expected %d bytes written, got %d", tc.name, msgLen, len(original), nWritten)
+			}
+			wg.Wait()
+			if readErr != nil {
+				t.Fatalf("[%s Len %d] ReadMsg failed: %v", tc.name, msgLen, readErr)
+			}
+			if !bytes.Equal(original, received) {
+				t.Fatalf("[%s Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", tc.name, msgLen, len(received), len(original))
+			}
+		}
+	}
+}
+
+// TestISOTP_Frames checks the encoding of ISO-TP frames.
+func TestISOTP_Frames(t *testing.T) {
+	cases := []struct {
+		name    string
+		segSize int
+		cfg     seg.ISOTPConfig
+		msgLen  int
+		frames  []string
+	}{
+		{"single", 8, seg.ISOTPConfig{}, 3,
+			[]string{"03 11 30 4f"}},
+		{"single-pad", 8, seg.ISOTPConfig{Pad: true, PadByte: 0xAA}, 3,
+			[]string{"03 11 30 4f aa aa aa aa"}},
+		{"single-fd", 64, seg.ISOTPConfig{}, 9,
+			[]string{"00 09 11 30 4f 6e 8d ac cb ea 09 cc"}},
+		{"multi", 8, seg.ISOTPConfig{}, 16,
+			[]string{"10 10 11 30 4f 6e 8d ac", "21 cb ea 09 28 47 66 85", "22 a4 c3 e2"}},
+	}
+	for _, tc := range cases {
+		a, b := newDuplexPair(10)
+		sender := seg.New(a, tc.segSize, "sender", seg.WithISOTP(tc.cfg))
+
+		errC := make(chan error)
+		go func() {
+			_, err := sender.Write(generateTestBuffer(tc.msgLen))
+			errC <- err
+		}()
+		for i, want := range tc.frames {
+			f := <-b.r.packets
+			if got := fmt.Sprintf("% x", f); got != want {
+				t.Fatalf("[%s] frame %d:\nGot:  %s\nWant: %s", tc.name, i, got, want)
+			}
+			if i == 0 && len(tc.frames) > 1 {
+				// clear to send
+				b.Write([]byte{0x30, 0, 0})
+			}
+		}
+		if err := <-errC; err != nil {
+			t.Fatalf("[%s] Write failed: %v", tc.name, err)
+		}
+	}
+}
+
+// TestAppendMsg verifies that AppendMsg appends to the buffer provided,
+// also after reassembly errors, and that ReadMsgInto detects short buffers.
+func TestAppendMsg(t *testing.T) {
+	pipe := newPacketPipe(20)
+	receiver := seg.New(pipe, 8, "receiver", seg.WithCRC16())
+	sender := seg.New(pipe, 8, "sender", seg.WithCRC16())
+
+	pipe.Write([]byte{0x82, 1, 2}) // start of an incomplete message
+	pipe.Write([]byte{})           // empty frame
+	original := generateTestBuffer(20)
+	sender.Write(original)
+
+	prefix := []byte("prefix")
+	msg, err := receiver.AppendMsg(prefix)
+	if err != nil {
+		t.Fatalf("AppendMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, append(prefix, original...)) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+
+	// the spare capacity of a short buffer must not be modified
+	sender.Write(original)
+	backing := bytes.Repeat([]byte{0xEE}, 32)
+	buf := backing[:10]
+	n, err := receiver.ReadMsgInto(buf)
+	if err != io.ErrShortBuffer {
+		t.Fatalf("Expected io.ErrShortBuffer, got %v", err)
+	}
+	if n != len(buf) || !bytes.Equal(buf, original[:n]) {
+		t.Fatalf("Unexpected message: % x", buf[:n])
+	}
+	if !bytes.Equal(backing[10:], bytes.Repeat([]byte{0xEE}, 22)) {
+		t.Fatalf("Bytes beyond the buffer modified: % x", backing[10:])
+	}
+
+	sender.Write(original)
+	buf = make([]byte, 64)
+	n, err = receiver.ReadMsgInto(buf)
+	if err != nil {
+		t.Fatalf("ReadMsgInto failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], original) {
+		t.Fatalf("Unexpected message: % x", buf[:n])
+	}
+}
+
+// loopConn replays a sequence of frames endlessly, without allocating.
+type loopConn struct {
+	frames [][]byte
+	i      int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	f := c.frames[c.i]
+	c.i = (c.i + 1) % len(c.frames)
+	return copy(b, f), nil
+}
+
+func (c *loopConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// newLoopConn records the frames of a message written using opts.
+func newLoopConn(segSize int, msg []byte, opts ...seg.Option) *loopConn {
+	pipe := newPacketPipe(1000)
+	seg.New(pipe, segSize, "sender", opts...).Write(msg)
+	c := new(loopConn)
+	for len(pipe.packets) != 0 {
+		c.frames = append(c.frames, <-pipe.packets)
+	}
+	return c
+}
+
+// TestAppendMsg_Allocs verifies that AppendMsg does not allocate.
+func TestAppendMsg_Allocs(t *testing.T) {
+	for _, msgLen := range []int{5, 100} {
+		conn := newLoopConn(8, generateTestBuffer(msgLen), seg.WithCRC32())
+		receiver := seg.New(conn, 8, "receiver", seg.WithCRC32())
+		buf := make([]byte, 0, 128)
+		allocs := testing.AllocsPerRun(100, func() {
+			msg, err := receiver.AppendMsg(buf[:0])
+			if err != nil || len(msg) != msgLen {
+				t.Fatalf("AppendMsg failed: %v", err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("[Len %d] Expected no allocations, got %v", msgLen, allocs)
+		}
+	}
+}
+
+func benchmarkAppendMsg(b *testing.B, segSize, msgLen int, opts ...seg.Option) {
+	conn := newLoopConn(segSize, generateTestBuffer(msgLen), opts...)
+	receiver := seg.New(conn, segSize, "receiver", opts...)
+	buf := make([]byte, 0, msgLen+4) // room for a checksum
+	b.SetBytes(int64(msgLen))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		_, err := receiver.AppendMsg(buf[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendMsg_Single(b *testing.B) { benchmarkAppendMsg(b, 8, 7) }
+func BenchmarkAppendMsg_CAN(b *testing.B)    { benchmarkAppendMsg(b, 8, 250) }
+func BenchmarkAppendMsg_CANFD(b *testing.B) {
+	benchmarkAppendMsg(b, 64, 500, seg.WithStrategy(seg.CANFDStrategy(64)))
+}
+func BenchmarkAppendMsg_CRC16(b *testing.B) { benchmarkAppendMsg(b, 8, 250, seg.WithCRC16()) }
+func BenchmarkAppendMsg_Extended(b *testing.B) {
+	benchmarkAppendMsg(b, 8, 2000, seg.WithExtendedHeader())
+}
+
+// TestMaxMsgSize verifies that messages exceeding the limit are rejected,
+// both at their start, and during reassembly.
+func TestMaxMsgSize(t *testing.T) {
+	pipe := newPacketPipe(100)
+	sender := seg.New(pipe, 8, "sender")
+	receiver := seg.New(pipe, 8, "receiver", seg.WithMaxMsgSize(30))
+
+	// start frame announcing more frames than the limit
+	pipe.Write([]byte{0xA0, 1, 2, 3, 4, 5, 6, 7})
+
+	// too large, but detected during reassembly
+	sender.Write(generateTestBuffer(50))
+
+	// acceptable
+	original := generateTestBuffer(30)
+	sender.Write(original)
+
+	for _, size := range []int{33, 35} {
+		_, err := receiver.ReadMsg()
+		var me *seg.MsgSizeError
+		if !errors.As(err, &me) {
+			t.Fatalf("Expected *seg.MsgSizeError, got %v", err)
+		}
+		if me.Limit != 30 || me.Size != size {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, original) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+	if st := receiver.Stats(); st.OversizedMsgs != 2 || st.MsgsReceived != 1 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
+
+// TestMaxMsgSize_Skip verifies that the remaining frames of a message
+// rejected during reassembly are skipped without further errors.
+func TestMaxMsgSize_Skip(t *testing.T) {
+	pipe := newPacketPipe(100)
+	sender := seg.New(pipe, 8, "sender")
+	var errs []error
+	receiver := seg.New(pipe, 8, "receiver", seg.WithMaxMsgSize(10), seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	sender.Write(generateTestBuffer(70))
+	original := generateTestBuffer(10)
+	sender.Write(original)
+
+	_, err := receiver.ReadMsg()
+	var me *seg.MsgSizeError
+	if !errors.As(err, &me) {
+		t.Fatalf("Expected *seg.MsgSizeError, got %v", err)
+	}
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(msg, original) {
+		t.Fatalf("Unexpected message: % x", msg)
+	}
+	st := receiver.Stats()
+	if st.OversizedMsgs != 1 || st.UnexpectedConts != 0 || st.MsgsReceived != 1 || len(errs) != 1 {
+		t.Fatalf("Unexpected stats: %+v, errors: %v", st, errs)
+	}
+}
+
+// TestMaxMsgSize_FlowControl verifies that the sender is notified
+// about a rejected message in flow control mode and with ISO-TP.
+func TestMaxMsgSize_FlowControl(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  seg.Option
+	}{
+		{"fc", seg.WithFlowControl(seg.FlowControl{})},
+		{"isotp", seg.WithISOTP(seg.ISOTPConfig{})},
+	} {
+		a, b := newDuplexPair(100)
+		sender := seg.New(a, 8, "sender", tc.opt)
+		receiver := seg.New(b, 8, "receiver", tc.opt, seg.WithMaxMsgSize(10))
+
+		readErr := make(chan error)
+		go func() {
+			_, err := receiver.ReadMsg()
+			readErr <- err
+		}()
+		_, err := sender.Write(generateTestBuffer(200))
+		if err != seg.ErrFlowControlOverflow {
+			t.Fatalf("[%s] Expected ErrFlowControlOverflow, got %v", tc.name, err)
+		}
+		var me *seg.MsgSizeError
+		if err := <-readErr; !errors.As(err, &me) {
+			t.Fatalf("[%s] Expected *seg.MsgSizeError, got %v", tc.name, err)
+		}
+	}
+}
+
+// TestMux transfers messages on several channels concurrently,
+// using an address byte as key.
+func TestMux(t *testing.T) {
+	const (
+		nChans = 4
+		nMsgs  = 20
+	)
+	split := func(frame []byte) (byte, []byte, bool) {
+		if len(frame) < 1 {
+			return 0, nil, false
+		}
+		return frame[0], frame[1:], true
+	}
+	// avoid dropped frames in case a receiver falls behind
+	defer func(n int) { seg.MuxQueueLen = n }(seg.MuxQueueLen)
+	seg.MuxQueueLen = nMsgs * 16
+
+	a, b := newDuplexPair(100)
+	muxA := seg.NewMux(a, 9, split)
+	muxB := seg.NewMux(b, 9, split)
+
+	var wg sync.WaitGroup
+	for ch := range byte(nChans) {
+		sender, err := muxA.Open(ch, []byte{ch}, "sender")
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := muxB.Open(ch, []byte{ch}, "receiver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range nMsgs {
+				msg := generateTestBuffer(10 + i*int(ch))
+				if _, err := sender.Write(msg); err != nil {
+					t.Errorf("[Chan %d] Write failed: %v", ch, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range nMsgs {
+				msg, err := receiver.ReadMsg()
+				if err != nil {
+					t.Errorf("[Chan %d] ReadMsg failed: %v", ch, err)
+					return
+				}
+				if want := generateTestBuffer(10 + i*int(ch)); !bytes.Equal(msg, want) {
+					t.Errorf("[Chan %d] payload mismatch: % x", ch, msg)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := muxB.Open(0, []byte{0}, "dup"); err != seg.ErrMuxChannelOpen {
+		t.Fatalf("Expected ErrMuxChannelOpen, got %v", err)
+	}
+
+	// frames for unknown channels are counted
+	a.Write([]byte{nChans, 0x80, 1})
+	a.Write([]byte{})
+	muxB.Close(0)
+	a.Write([]byte{0, 0x80, 1})
+	for start := time.Now(); time.Since(start) < time.Second; {
+		if st := muxB.Stats(); st.Unknown == 2 && st.Invalid == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := muxB.Stats(); st.Unknown != 2 || st.Invalid != 1 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
+
+// TestMux_Truncated verifies that frames with a shorter address prefix
+// than the one written, which don't fit into the channel's frame size,
+// are reported as truncated.
+func TestMux_Truncated(t *testing.T) {
+	split := func(frame []byte) (byte, []byte, bool) {
+		if len(frame) < 1 {
+			return 0, nil, false
+		}
+		return frame[0], frame[1:], true
+	}
+	a, b := newDuplexPair(10)
+	mux := seg.NewMux(b, 9, split)
+	receiver, err := mux.Open(1, []byte{1, 0xAA}, "receiver") // frame size 7
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte{1, 0x80, 1, 2, 3, 4, 5, 6, 7})
+	a.Write([]byte{1, 0x80, 1, 2, 3, 4, 5, 6})
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if want := []byte{1, 2, 3, 4, 5, 6}; !bytes.Equal(msg, want) {
+		t.Fatalf("Expected % x, got % x", want, msg)
+	}
+	if n := receiver.Stats().TruncatedFrames; n != 1 {
+		t.Fatalf("Expected 1 truncated frame, got %d", n)
+	}
+}
+
+// TestReassembler interleaves the frames of messages from several
+// senders, distinguished by a tag byte, and reverses the order of
+// continuation frames for some of them.
+func TestReassembler(t *testing.T) {
+	const nSenders = 5
+	split := func(frame []byte) (byte, []byte, bool) {
+		if len(frame) < 1 {
+			return 0, nil, false
+		}
+		return frame[0], frame[1:], true
+	}
+
+	// record the frames of each sender
+	frames := make([][][]byte, nSenders)
+	for tag := range nSenders {
+		pipe := newPacketPipe(50)
+		seg.New(pipe, 8, "sender").Write(generateTestBuffer(20 + 10*tag))
+		for len(pipe.packets) != 0 {
+			frames[tag] = append(frames[tag], append([]byte{byte(tag)}, <-pipe.packets...))
+		}
+		if tag%2 == 1 {
+			cont := frames[tag][1:]
+			slices.Reverse(cont)
+		}
+	}
+
+	pipe := newPacketPipe(100)
+	for i := 0; ; i++ {
+		n := 0
+		for tag := range nSenders {
+			if i < len(frames[tag]) {
+				pipe.Write(frames[tag][i])
+				n++
+			}
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	r := seg.NewReassembler(seg.New(pipe, 9, "receiver"), split, 0)
+	seen := make(map[byte]bool)
+	for range nSenders {
+		tag, msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %v", err)
+		}
+		if want := generateTestBuffer(20 + 10*int(tag)); !bytes.Equal(msg, want) {
+			t.Fatalf("[Tag %d] payload mismatch: % x", tag, msg)
+		}
+		seen[tag] = true
+	}
+	if len(seen) != nSenders || r.Pending() != 0 {
+		t.Fatalf("Unexpected result: %v, %d pending", seen, r.Pending())
+	}
+}
+
+// TestReassembler_Timeout verifies that an incomplete message is discarded
+// after the slot timeout.
+func TestReassembler_Timeout(t *testing.T) {
+	split := func(frame []byte) (byte, []byte, bool) {
+		return frame[0], frame[1:], true
+	}
+	var errs []error
+	pipe := newPacketPipe(10)
+	s := seg.New(pipe, 9, "receiver", seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+	r := seg.NewReassembler(s, split, 10*time.Millisecond)
+
+	pipe.Write([]byte{1, 0x82, 1, 2}) // sender 1, incomplete
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pipe.Write([]byte{2, 0x81, 3, 4})
+		pipe.Write([]byte{2, 0x01, 5, 6})
+	}()
+	tag, msg, err := r.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if tag != 2 || !bytes.Equal(msg, []byte{3, 4, 5, 6}) {
+		t.Fatalf("Unexpected message from %d: % x", tag, msg)
+	}
+	var te *seg.TimeoutError
+	if len(errs) != 1 || !errors.As(errs[0], &te) {
+		t.Fatalf("Expected one timeout, got %v", errs)
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("Expected no pending messages, got %d", r.Pending())
+	}
+}
+
+// TestReassembler_TimeoutIdle verifies that an incomplete message is
+// discarded after the slot timeout even if no further frames arrive.
+func TestReassembler_TimeoutIdle(t *testing.T) {
+	split := func(frame []byte) (byte, []byte, bool) {
+		return frame[0], frame[1:], true
+	}
+	var errs []error
+	pipe := newPacketPipe(10)
+	s := seg.New(pipe, 9, "receiver", seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+	r := seg.NewReassembler(s, split, 10*time.Millisecond)
+
+	pipe.Write([]byte{1, 0x82, 1, 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := r.ReadMsgContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	var te *seg.TimeoutError
+	if len(errs) != 1 || !errors.As(errs[0], &te) {
+		t.Fatalf("Expected one timeout, got %v", errs)
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("Expected no pending messages, got %d", r.Pending())
+	}
+}
+
+// TestReassembler_MaxSlots verifies that the least recently active
+// message is discarded if all slots are in use.
+func TestReassembler_MaxSlots(t *testing.T) {
+	split := func(frame []byte) (byte, []byte, bool) {
+		return frame[0], frame[1:], true
+	}
+	var errs []error
+	pipe := newPacketPipe(10)
+	s := seg.New(pipe, 9, "receiver", seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+	r := seg.NewReassembler(s, split, 0)
+	r.SetMaxSlots(2)
+
+	pipe.Write([]byte{1, 0x81, 1})
+	pipe.Write([]byte{2, 0x81, 2})
+	pipe.Write([]byte{3, 0x81, 3}) // discards message 1
+	pipe.Write([]byte{1, 0x01, 4}) // discards message 2
+	pipe.Write([]byte{3, 0x01, 5})
+	tag, msg, err := r.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if tag != 3 || !bytes.Equal(msg, []byte{3, 5}) {
+		t.Fatalf("Unexpected message from %d: % x", tag, msg)
+	}
+	if len(errs) != 2 || errs[0] != seg.ErrTooManyMsgs || errs[1] != seg.ErrTooManyMsgs {
+		t.Fatalf("Expected two discarded messages, got %v", errs)
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("Expected one pending message, got %d", r.Pending())
+	}
+}
+
+// TestReassembler_MaxMsgSize verifies that a continuation frame
+// arriving before its start frame is rejected if its index
+// implies a message exceeding the size limit, and that a start frame
+// exceeding the limit discards frames of its message received before.
+func TestReassembler_MaxMsgSize(t *testing.T) {
+	split := func(frame []byte) (byte, []byte, bool) {
+		return frame[0], frame[1:], true
+	}
+	pipe := newPacketPipe(10)
+	r := seg.NewReassembler(seg.New(pipe, 9, "receiver", seg.WithMaxMsgSize(16)), split, 0)
+
+	pipe.Write([]byte{1, 0x7F, 1})
+
+	// a start frame arriving after a continuation frame
+	pipe.Write([]byte{2, 0x01, 2})
+	pipe.Write([]byte{2, 0xA0, 3})
+
+	for range 2 {
+		_, _, err := r.ReadMsg()
+		var me *seg.MsgSizeError
+		if !errors.As(err, &me) {
+			t.Fatalf("Expected *MsgSizeError, got %v", err)
+		}
+		if r.Pending() != 0 {
+			t.Fatalf("Expected no pending messages, got %d", r.Pending())
+		}
+	}
+}
+
+// TestDuplicateTolerance feeds duplicated start, continuation,
+// and single frames to ReadMsg.
+func TestDuplicateTolerance(t *testing.T) {
+	pipe := newPacketPipe(20)
+	receiver := seg.New(pipe, 8, "receiver", seg.WithDuplicateTolerance(0))
+
+	frames := [][]byte{
+		{0x82, 1, 2},
+		{0x82, 1, 2}, // duplicated start
+		{0x01, 3, 4},
+		{0x01, 3, 4}, // duplicated continuation
+		{0x02, 5, 6},
+		{0x80, 7, 8},
+		{0x80, 7, 8}, // duplicated single
+		{0x80, 9},
+	}
+	for _, f := range frames {
+		pipe.Write(f)
+	}
+	for _, want := range [][]byte{{1, 2, 3, 4, 5, 6}, {7, 8}, {9}} {
+		msg, err := receiver.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %v", err)
+		}
+		if !bytes.Equal(msg, want) {
+			t.Fatalf("Expected % x, got % x", want, msg)
+		}
+	}
+	want := seg.Stats{FramesReceived: uint64(len(frames)), MsgsReceived: 3, Duplicates: 3}
+	if st := receiver.Stats(); st != want {
+		t.Fatalf("Unexpected stats:\nGot:  %+v\nWant: %+v", st, want)
+	}
+}
+
+// TestDuplicateTolerance_Window verifies that a repeated frame
+// received after the time window is not regarded a duplicate.
+func TestDuplicateTolerance_Window(t *testing.T) {
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		pipe := newPacketPipe(20)
+		receiver := seg.New(pipe, 8, "receiver", seg.WithDuplicateTolerance(window))
+
+		for range 2 {
+			pipe.Write([]byte{0x80, 1})
+			msg, err := receiver.ReadMsg()
+			if err != nil {
+				t.Fatalf("ReadMsg failed: %v", err)
+			}
+			if !bytes.Equal(msg, []byte{1}) {
+				t.Fatalf("Unexpected message: % x", msg)
+			}
+			time.Sleep(max(window, seg.DefaultDuplicateWindow) + 20*time.Millisecond)
+		}
+		if n := receiver.Stats().Duplicates; n != 0 {
+			t.Fatalf("[window %v] Expected no duplicates, got %d", window, n)
+		}
+	}
+}
+
+// TestDuplicateTolerance_Repeated verifies that only a single
+// repetition of a frame is regarded a duplicate.
+func TestDuplicateTolerance_Repeated(t *testing.T) {
+	pipe := newPacketPipe(20)
+	receiver := seg.New(pipe, 8, "receiver", seg.WithDuplicateTolerance(time.Second))
+
+	for range 3 {
+		pipe.Write([]byte{0x80, 1})
+	}
+	for range 2 {
+		msg, err := receiver.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %v", err)
+		}
+		if !bytes.Equal(msg, []byte{1}) {
+			t.Fatalf("Unexpected message: % x", msg)
+		}
+	}
+	if n := receiver.Stats().Duplicates; n != 1 {
+		t.Fatalf("Expected 1 duplicate, got %d", n)
+	}
+}
+
+// lossyConn drops frames written, as selected by a function.
+type lossyConn struct {
+	*duplex
+	drop func() bool
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	if c.drop() {
+		return len(b), nil
+	}
+	return c.duplex.Write(b)
+}
+
+// TestSelectiveRepeat_AllLengths transfers messages over a link
+// that loses frames written by the sender.
+func TestSelectiveRepeat_AllLengths(t *testing.T) {
+	const maxLen = 60
+	masterPayload := generateTestBuffer(maxLen)
+
+	sr := seg.SelectiveRepeat{Retries: 10, Timeout: 20 * time.Millisecond}
+	for _, ext := range []bool{false, true} {
+		var opts []seg.Option
+		if ext {
+			opts = append(opts, seg.WithExtendedHeader())
+		}
+		opts = append(opts, seg.WithSelectiveRepeat(sr))
+		a, b := newDuplexPair(50)
+		rnd := rand.New(rand.NewPCG(1, 2))
+		lossy := &lossyConn{duplex: a}
+		sender := seg.New(lossy, 8, "sender", opts...)
+		receiver := seg.New(b, 8, "receiver", opts...)
+
+		for msgLen := 1; msgLen <= maxLen; msgLen++ {
+			original := masterPayload[:msgLen]
+			lossy.drop = func() bool {
+				// single frames are not retransmitted
+				return msgLen > 7 && rnd.IntN(4) == 0
+			}
+
+			var wg sync.WaitGroup
+			var received []byte
+			var readErr error
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				received, readErr = receiver.ReadMsg()
+			}()
+
+			nWritten, err := sender.Write(original)
+			if err != nil {
+				t.Fatalf("[Ext %v Len %d] Write failed: %v", ext, msgLen, err)
+			}
+			if nWritten != len(original) {
+				t.Fatalf("[Ext %v Len %d] Expected %d bytes written, got %d", ext, msgLen, len(original), nWritten)
+			}
+			wg.Wait()
+			if readErr != nil {
+				t.Fatalf("[Ext %v Len %d] ReadMsg failed: %v", ext, msgLen, readErr)
+			}
+			if !bytes.Equal(original, received) {
+				t.Fatalf("[Ext %v Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", ext, msgLen, len(received), len(original))
+			}
+		}
+		if n := sender.Stats().Retransmits; n == 0 {
+			t.Fatalf("[Ext %v] Expected retransmitted frames", ext)
+		}
+	}
+}
+
+// TestSelectiveRepeat_Sender checks the sender's reaction on
+// acknowledgements that are generated manually.
+func TestSelectiveRepeat_Sender(t *testing.T) {
+	msg := generateTestBuffer(20) // three frames
+
+	const stale = 0xFF // marks an acknowledgement of another message
+	cases := []struct {
+		name    string
+		wait    []int    // frames to wait for before each acknowledgement
+		acks    [][]byte // headers of the missing frames of each acknowledgement
+		err     error
+		nFrames int
+	}{
+		{"ack", []int{3}, [][]byte{{}}, nil, 3},
+		{"timeout", nil, nil, seg.ErrAckTimeout, 3 + 2*3},
+		{"missing", []int{3, 1, 2}, [][]byte{{2}, {0x82, 1}, {}}, nil, 3 + 1 + 2},
+		{"limit", []int{3, 1, 1}, [][]byte{{1}, {1}, {1}}, seg.ErrRetransmitLimit, 3 + 2},
+		{"stale", []int{3}, [][]byte{{stale}}, seg.ErrAckTimeout, 3 + 2*3},
+	}
+	for _, tc := range cases {
+		a, b := newDuplexPair(20)
+		sender := seg.New(a, 8, "sender", seg.WithSelectiveRepeat(seg.SelectiveRepeat{Retries: 2, Timeout: 50 * time.Millisecond}))
+
+		errC := make(chan error)
+		go func() {
+			_, err := sender.Write(msg)
+			errC <- err
+		}()
+
+		n := 0
+		var seq byte
+		for i, missing := range tc.acks {
+			for range tc.wait[i] {
+				f := <-b.r.packets
+				if n == 0 {
+					seq = f[1]
+				}
+				n++
+			}
+			ack := []byte{0, 0x80, seq}
+			if len(missing) == 1 && missing[0] == stale {
+				ack[2]++
+			} else {
+				ack = append(ack, missing...)
+			}
+			b.Write(ack)
+		}
+		if err := <-errC; err != tc.err {
+			t.Fatalf("[%s] Expected error %v, got %v", tc.name, tc.err, err)
+		}
+		if n += len(b.r.packets); n != tc.nFrames {
+			t.Fatalf("[%s] Expected %d frames, got %d", tc.name, tc.nFrames, n)
+		}
+	}
+}
+
+// dropAcks drops acknowledgements written,
+// while enabled, and counts them.
+type dropAcks struct {
+	*duplex
+	enabled bool
+	mu      sync.Mutex
+	dropped int
+}
+
+func (c *dropAcks) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enabled && len(b) >= 2 && b[0] == 0 && b[1] == 0x80 {
+		c.dropped++
+		return len(b), nil
+	}
+	return c.duplex.Write(b)
+}
+
+// TestSelectiveRepeat_LostAck verifies that a message is delivered
+// only once, if the final acknowledgement gets lost, and the sender
+// retransmits the whole message.
+func TestSelectiveRepeat_LostAck(t *testing.T) {
+	opt := seg.WithSelectiveRepeat(seg.SelectiveRepeat{Retries: 3, Timeout: 30 * time.Millisecond})
+	a, b := newDuplexPair(50)
+	rconn := &dropAcks{duplex: b, enabled: true}
+	sender := seg.New(a, 8, "sender", opt)
+	receiver := seg.New(rconn, 8, "receiver", opt)
+
+	msgC := make(chan []byte, 4)
+	go func() {
+		for {
+			msg, err := receiver.ReadMsg()
+			if err != nil {
+				return
+			}
+			msgC <- bytes.Clone(msg)
+			rconn.mu.Lock()
+			if rconn.dropped == 1 {
+				// let the acknowledgement of the retransmission pass
+				rconn.enabled = false
+			}
+			rconn.mu.Unlock()
+		}
+	}()
+
+	msgs := [][]byte{generateTestBuffer(20), generateTestBuffer(30)}
+	for _, msg := range msgs {
+		_, err := sender.Write(msg)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	for _, want := range msgs {
+		select {
+		case got := <-msgC:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Expected % x, got % x", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message missing")
+		}
+	}
+	select {
+	case msg := <-msgC:
+		t.Fatalf("message delivered twice: % x", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := sender.Stats().Retransmits; n != 3 {
+		t.Fatalf("Expected 3 retransmitted frames, got %d", n)
+	}
+}
+
+// TestSelectiveRepeat_Abandoned verifies that frames of an abandoned
+// message are not merged with a new message, even if its start frame
+// is identical.
+func TestSelectiveRepeat_Abandoned(t *testing.T) {
+	a, b := newDuplexPair(20)
+	receiver := seg.New(b, 8, "receiver", seg.WithSelectiveRepeat(seg.SelectiveRepeat{}))
+
+	for _, f := range [][]byte{
+		{0x82, 7, 1, 2, 3, 4, 5, 6}, // message 7, three frames
+		{0x02, 'x', 'x'},            // frame 1 is lost
+		{0x82, 8, 1, 2, 3, 4, 5, 6}, // message 8, same data
+		{0x01, 'a'},
+		{0x02, 'b'},
+	} {
+		a.Write(f)
+	}
+	msg, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if want := []byte{1, 2, 3, 4, 5, 6, 'a', 'b'}; !bytes.Equal(msg, want) {
+		t.Fatalf("Expected % x, got % x", want, msg)
+	}
+}
+
+// letterCodec is a header format using a letter for the kind
+// of each frame, followed by the frame count or index.
+type letterCodec struct{}
+
+func (letterCodec) HeaderLen(seg.Header) int { return 2 }
+func (letterCodec) MaxFrames() int           { return 256 }
+func (letterCodec) IndexMod() int            { return 0 }
+
+func (letterCodec) PutHeader(b []byte, h seg.Header) int {
+	switch h.Kind {
+	case seg.SingleFrame:
+		b[0], b[1] = 'S', 1
+	case seg.StartFrame:
+		b[0], b[1] = 'F', byte(h.Count-1)
+	case seg.ContFrame:
+		b[0], b[1] = 'C', byte(h.Index)
+	default:
+		b[0], b[1] = 'X', h.Status
+	}
+	return 2
+}
+
+func (letterCodec) ParseHeader(b []byte) (h seg.Header, n int, ok bool) {
+	if len(b) < 2 {
+		return h, 0, false
+	}
+	switch b[0] {
+	case 'S':
+		h = seg.Header{Kind: seg.SingleFrame, Count: 1}
+	case 'F':
+		h = seg.Header{Kind: seg.StartFrame, Count: int(b[1]) + 1}
+	case 'C':
+		h = seg.Header{Kind: seg.ContFrame, Index: int(b[1])}
+	default:
+		h = seg.Header{Kind: seg.ControlFrame, Status: b[1]}
+	}
+	return h, 2, true
+}
+
+// tagCodec is a header format using a letter for the kind of each frame,
+// followed by the message tag, and the message length or the index.
+type tagCodec struct{}
+
+func (tagCodec) HeaderLen(seg.Header) int { return 3 }
+func (tagCodec) MaxFrames() int           { return 0 }
+func (tagCodec) IndexMod() int            { return 256 }
+
+func (tagCodec) PutHeader(b []byte, h seg.Header) int {
+	switch h.Kind {
+	case seg.SingleFrame:
+		b[0], b[2] = 'S', byte(h.Len)
+	case seg.StartFrame:
+		b[0], b[2] = 'F', byte(h.Len)
+	case seg.ContFrame:
+		b[0], b[2] = 'C', byte(h.Index)
+	default:
+		b[0], b[2] = 'X', h.Status
+	}
+	b[1] = byte(h.Tag)
+	return 3
+}
+
+func (tagCodec) ParseHeader(b []byte) (h seg.Header, n int, ok bool) {
+	if len(b) < 3 {
+		return h, 0, false
+	}
+	switch b[0] {
+	case 'S':
+		h = seg.Header{Kind: seg.SingleFrame, Len: int(b[2])}
+	case 'F':
+		h = seg.Header{Kind: seg.StartFrame, Len: int(b[2])}
+	case 'C':
+		h = seg.Header{Kind: seg.ContFrame, Index: int(b[2])}
+	default:
+		h = seg.Header{Kind: seg.ControlFrame, Status: b[2]}
+	}
+	h.Tag = int(b[1])
+	return h, 3, true
+}
+
+// TestCodec transfers messages using a custom header format.
+func TestCodec(t *testing.T) {
+	const maxLen = 100
+	masterPayload := generateTestBuffer(maxLen)
+
+	pipe := newPacketPipe(50)
+	sender := seg.New(pipe, 8, "sender", seg.WithCodec(letterCodec{}))
+	receiver := seg.New(pipe, 8, "receiver", seg.WithCodec(letterCodec{}))
+
+	for msgLen := 1; msgLen <= maxLen; msgLen++ {
+		original := masterPayload[:msgLen]
+		_, err := sender.Write(original)
+		if err != nil {
+			t.Fatalf("[Len %d] Write failed: %v", msgLen, err)
+		}
+		if msgLen == 12 {
+			// check the frames without reassembling them
+			for i, want := range []string{"F\x01", "C\x01"} {
+				f := <-pipe.packets
+				if string(f[:2]) != want {
+					t.Fatalf("[Len %d] frame %d: unexpected header % x", msgLen, i, f[:2])
+				}
+			}
+			continue
+		}
+		received, err := receiver.ReadMsg()
+		if err != nil {
+			t.Fatalf("[Len %d] ReadMsg failed: %v", msgLen, err)
+		}
+		if !bytes.Equal(original, received) {
+			t.Fatalf("[Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", msgLen, len(received), len(original))
+		}
+	}
+}
+
+// TestCodec_Tags transfers messages using a header format announcing
+// the message length, and verifies that a continuation frame tagged
+// with a different message aborts reassembly.
+func TestCodec_Tags(t *testing.T) {
+	const maxLen = 100
+	masterPayload := generateTestBuffer(maxLen)
+
+	var errs []error
+	pipe := newPacketPipe(50)
+	sender := seg.New(pipe, 8, "sender", seg.WithCodec(tagCodec{}))
+	receiver := seg.New(pipe, 8, "receiver", seg.WithCodec(tagCodec{}), seg.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	for msgLen := 1; msgLen <= maxLen; msgLen++ {
+		original := masterPayload[:msgLen]
+		_, err := sender.Write(original)
+		if err != nil {
+			t.Fatalf("[Len %d] Write failed: %v", msgLen, err)
+		}
+		received, err := receiver.ReadMsg()
+		if err != nil {
+			t.Fatalf("[Len %d] ReadMsg failed: %v", msgLen, err)
+		}
+		if !bytes.Equal(original, received) {
+			t.Fatalf("[Len %d] payload mismatch!\nGot len:  %d\nWant len: %d", msgLen, len(received), len(original))
+		}
+	}
+
+	// a message of 12 bytes: 5 + 5 + 2 bytes of data
+	sender.Write(masterPayload[:12])
+	var tags []byte
+	for i, want := range []string{"F\x0c", "C\x01", "C\x02"} {
+		f := <-pipe.packets
+		if h := string(f[0:1]) + string(f[2:3]); h != want {
+			t.Fatalf("frame %d: unexpected header % x", i, f[:3])
+		}
+		tags = append(tags, f[1])
+	}
+	if tags[0] != maxLen+1 || tags[1] != tags[0] || tags[2] != tags[0] {
+		t.Fatalf("Unexpected tags: % x", tags)
+	}
+
+	pipe.Write([]byte{'F', 7, 10, 1, 2, 3, 4, 5})
+	pipe.Write([]byte{'C', 8, 1, 6, 7, 8, 9, 10}) // of a different message
+	original := masterPayload[:10]
+	sender.Write(original)
+	received, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(original, received) {
+		t.Fatalf("Unexpected message: % x", received)
+	}
+	if len(errs) != 1 || errs[0] != seg.ErrSeqGap {
+		t.Fatalf("Expected ErrSeqGap, got %v", errs)
+	}
+}
+
+// TestLenCheck verifies that a message is rejected as soon as
+// the length check fails, and that its remaining frames are skipped.
+func TestLenCheck(t *testing.T) {
+	errLen := errors.New("unexpected length")
+	pipe := newPacketPipe(20)
+	sender := seg.New(pipe, 8, "sender")
+	receiver := seg.New(pipe, 8, "receiver")
+
+	const expected = 20
+	var calls [][2]int
+	receiver.SetLenCheck(func(data []byte, min, max int) error {
+		calls = append(calls, [2]int{min, max})
+		if expected < min || expected > max {
+			return errLen
+		}
+		return nil
+	})
+
+	msg := generateTestBuffer(30)
+	sender.Write(msg[:expected])
+	sender.Write(msg) // five frames
+	sender.Write(msg[:5])
+
+	received, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(received, msg[:expected]) {
+		t.Fatalf("Unexpected message: % x", received)
+	}
+	_, err = receiver.ReadMsg()
+	if err != errLen {
+		t.Fatalf("Expected error %v, got %v", errLen, err)
+	}
+	wantCalls := [][2]int{{9, 21}, {15, 21}, {11, 35}, {17, 35}, {23, 35}}
+	if !slices.Equal(calls, wantCalls) {
+		t.Fatalf("Unexpected bounds: %v, want %v", calls, wantCalls)
+	}
+	received, err = receiver.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	if !bytes.Equal(received, msg[:5]) {
+		t.Fatalf("Unexpected message: % x", received)
+	}
+	st := receiver.Stats()
+	if st.RejectedMsgs != 1 || st.UnexpectedConts != 0 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
+
+// TestLenCheck_FlowControl verifies that the sender is notified
+// in flow control mode if a message is rejected by the length check
+// after the first block of continuation frames has been requested.
+func TestLenCheck_FlowControl(t *testing.T) {
+	errLen := errors.New("unexpected length")
+	fc := seg.FlowControl{BlockSize: 2, Timeout: 200 * time.Millisecond}
+	for _, tc := range []struct {
+		name string
+		opts []seg.Option
+	}{
+		{"fc", []seg.Option{seg.WithFlowControl(fc)}},
+		{"isotp", []seg.Option{seg.WithISOTP(seg.ISOTPConfig{}), seg.WithFlowControl(fc)}},
+	} {
+		a, b := newDuplexPair(100)
+		sender := seg.New(a, 8, "sender", tc.opts...)
+		receiver := seg.New(b, 8, "receiver", tc.opts...)
+		nCalls := 0
+		receiver.SetLenCheck(func(data []byte, min, max int) error {
+			nCalls++
+			if nCalls == 2 {
+				return errLen
+			}
+			return nil
+		})
+
+		readErr := make(chan error)
+		go func() {
+			_, err := receiver.ReadMsg()
+			readErr <- err
+		}()
+		_, err := sender.Write(generateTestBuffer(40))
+		if err != seg.ErrFlowControlOverflow {
+			t.Fatalf("[%s] Expected ErrFlowControlOverflow, got %v", tc.name, err)
+		}
+		if err := <-readErr; err != errLen {
+			t.Fatalf("[%s] Expected error %v, got %v", tc.name, errLen, err)
+		}
+	}
+}
+
+func TestPacketFrameConn(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer a.Close()
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer b.Close()
+
+	sender := seg.NewFromFrameConn(seg.PacketFrameConn(a, b.LocalAddr()), 8, "sender")
+	receiver := seg.NewFromFrameConn(seg.PacketFrameConn(b, a.LocalAddr()), 8, "receiver")
+
+	// an oversized datagram must be skipped
+	_, err = a.WriteTo(make([]byte, 9), b.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := generateTestBuffer(30)
+	_, err = sender.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := receiver.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got % x, want % x", got, msg)
+	}
+	if n := receiver.Stats().TruncatedFrames; n != 1 {
+		t.Errorf("TruncatedFrames: got %d, want 1", n)
+	}
+}
+
+// TestDatagramFrameConn transfers messages over a connected UDP socket,
+// and checks the source reported.
+func TestDatagramFrameConn(t *testing.T) {
+	pb, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pb.Close()
+	a, err := net.Dial("udp", pb.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	receiver := seg.NewFromFrameConn(seg.DatagramFrameConn(a), 8, "receiver")
+	sender := seg.NewFromFrameConn(seg.PacketFrameConn(pb, a.LocalAddr()), 8, "sender")
+
+	// an oversized datagram must be skipped
+	_, err = pb.WriteTo(make([]byte, 9), a.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := generateTestBuffer(30)
+	_, err = sender.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, info, err := receiver.ReadMsgInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got % x, want % x", got, msg)
+	}
+	if info.Source != a.RemoteAddr() {
+		t.Errorf("Source: got %v, want %v", info.Source, a.RemoteAddr())
+	}
+	if n := receiver.Stats().TruncatedFrames; n != 1 {
+		t.Errorf("TruncatedFrames: got %d, want 1", n)
+	}
+}
+
+type shortWriter struct {
+	packetPipe
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	return len(b) - 1, nil
+}
+
+func TestReadWriterFrameConn_ShortWrite(t *testing.T) {
+	s := seg.New(&shortWriter{}, 8, "sender")
+	_, err := s.Write([]byte("abc"))
+	if err != io.ErrShortWrite {
+		t.Errorf("got %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// scriptConn is a FrameConn returning predefined frames, each
+// received one second after the previous one.
+type scriptConn struct {
+	frames [][]byte
+	i      int
+}
+
+func (c *scriptConn) ReadFrame(b []byte) (int, seg.FrameInfo, error) {
+	if c.i == len(c.frames) {
+		return 0, seg.FrameInfo{}, io.EOF
+	}
+	f := c.frames[c.i]
+	c.i++
+	info := seg.FrameInfo{Time: time.Unix(int64(c.i), 0), Source: "peer"}
+	return copy(b, f), info, nil
+}
+
+func (c *scriptConn) WriteFrame(b []byte) error { return nil }
+
+func TestReadMsgInfo(t *testing.T) {
+	conn := &scriptConn{frames: [][]byte{
+		{0x01, 'x'},              // stray continuation frame
+		{0x82, 'a', 'b'},         // start frame
+		{0x01, 'c'},              // cont
+		{0x02, 'd'},              // cont
+		{0x80, 'e'},              // single frame
+		{0x81, 'f'}, {0x80, 'g'}, // aborted start frame, single frame
+	}}
+	s := seg.NewFromFrameConn(conn, 8, "receiver")
+
+	tests := []struct {
+		msg  string
+		info seg.MsgInfo
+	}{
+		{"abcd", seg.MsgInfo{First: time.Unix(2, 0), Last: time.Unix(4, 0), Frames: 3, Source: "peer", Discarded: 1}},
+		{"e", seg.MsgInfo{First: time.Unix(5, 0), Last: time.Unix(5, 0), Frames: 1, Source: "peer"}},
+		{"g", seg.MsgInfo{First: time.Unix(7, 0), Last: time.Unix(7, 0), Frames: 1, Source: "peer", Discarded: 1}},
+	}
+	for _, tt := range tests {
+		msg, info, err := s.ReadMsgInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != tt.msg {
+			t.Errorf("got %q, want %q", msg, tt.msg)
+		}
+		if info != tt.info {
+			t.Errorf("%s: got %+v, want %+v", tt.msg, info, tt.info)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package seg
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// SelectiveRepeat configures the selective repeat mode, which makes
+// the transfer of multi-frame messages reliable on lossy links:
+// the receiver acknowledges a complete message, or reports the indexes
+// of frames that are missing, which the sender then retransmits.
+// Both peers must enable selective repeat.
+type SelectiveRepeat struct {
+	// Sender side: maximum number of retransmission rounds per message;
+	// DefaultSelectiveRepeatRetries, if zero. The receiver gives up
+	// after reporting missing frames this many times in a row
+	// without receiving any of them.
+	Retries int
+
+	// Sender side: maximum time to wait for an acknowledgement,
+	// before the whole message is retransmitted.
+	// Receiver side: missing frames are reported if no frame
+	// has been received within half of this time.
+	// DefaultSelectiveRepeatTimeout, if zero.
+	Timeout time.Duration
+}
+
+var (
+	DefaultSelectiveRepeatRetries = 3
+	DefaultSelectiveRepeatTimeout = 200 * time.Millisecond
+)
+
+// Errors returned by Write in selective repeat mode.
+var (
+	ErrAckTimeout      = errors.New("seg: timeout waiting for acknowledgement")
+	ErrRetransmitLimit = errors.New("seg: retransmission limit exceeded")
+)
+
+// WithSelectiveRepeat enables the selective repeat mode.
+// Single-frame messages are not acknowledged.
+//
+// Each message is preceded by a sequence number of one byte, which is
+// transferred as part of the data of its first frame. Acknowledgements
+// are control frames like those of the flow control mode, with
+// a status of 0x80. The header is followed by the sequence number
+// of the message, and the indexes of missing frames, each encoded
+// like the header of the respective frame. Acknowledgements are limited to eight bytes;
+// missing frames that don't fit are reported in subsequent rounds.
+// They are recognized by a goroutine that reads frames in the
+// background, and that is started by New.
+//
+// If the final acknowledgement gets lost, the sender retransmits the
+// whole message. The receiver recognizes it by its sequence number,
+// and acknowledges it again, without delivering it a second time.
+// Selective repeat cannot be combined with flow control or ISO-TP,
+// which take precedence. It requires a header format announcing
+// frame counts, whose continuation indexes do not wrap around.
+func WithSelectiveRepeat(sr SelectiveRepeat) Option {
+	return func(s *Seg) {
+		if sr.Retries == 0 {
+			sr.Retries = DefaultSelectiveRepeatRetries
+		}
+		if sr.Timeout == 0 {
+			sr.Timeout = DefaultSelectiveRepeatTimeout
+		}
+		s.sr = &selectiveRepeat{
+			SelectiveRepeat: sr,
+			c:               make(chan srAckInfo, 1),
+			txSeq:           byte(rand.IntN(256)),
+		}
+	}
+}
+
+// control frame status of acknowledgements, distinct from flow status values
+const srAck = 0x80
+
+// srMaxAckLen limits the length of acknowledgements,
+// so that they fit into a classic CAN frame.
+const srMaxAckLen = 8
+
+type selectiveRepeat struct {
+	SelectiveRepeat
+
+	// sender side
+	c     chan srAckInfo // acknowledgements received
+	offs  []int          // data offsets of the frames of the message being written
+	txSeq byte           // sequence number of the message being written
+
+	// receiver side
+	rxSeq       byte      // sequence number of the message delivered last
+	deliveredAt time.Time // zero, if no message has been delivered
+	skipConts   bool      // skip continuation frames of a message delivered already
+}
+
+// srAckInfo is the content of an acknowledgement.
+type srAckInfo struct {
+	seq     byte
+	missing []int // indexes of missing frames
+}
+
+// delivered reports whether the message with sequence number seq
+// has been delivered already, and may still be retransmitted.
+func (sr *selectiveRepeat) delivered(seq byte) bool {
+	if sr.deliveredAt.IsZero() || seq != sr.rxSeq {
+		return false
+	}
+	return time.Since(sr.deliveredAt) < time.Duration(sr.Retries+1)*sr.Timeout
+}
+
+func (s *Seg) appendMsgSR(ctx context.Context, dst []byte) ([]byte, error) {
+	var parts [][]byte // data of each frame, indexed by frame number
+	var nParts, size, last, nReports int
+	var seq byte
+
+	sr := s.sr
+	off := len(dst)
+	for {
+		var timeout time.Duration
+		if parts != nil {
+			timeout = sr.Timeout / 2
+		}
+		b, err := s.readFrame(ctx, timeout)
+		if err != nil {
+			if err == errFrameTimeout {
+				if nReports < sr.Retries {
+					nReports++
+					last, err = s.reportMissing(seq, parts)
+					if err != nil {
+						return dst[:off], err
+					}
+					continue
+				}
+				err = &TimeoutError{Received: nParts, Expected: len(parts)}
+				s.recvError(err)
+			}
+			return dst[:off], err
+		}
+		s.countStat(&s.stats.FramesReceived)
+		if s.isDuplicate(b) {
+			s.releaseFrame(b)
+			continue
+		}
+		hdr, h, ok := s.codec.ParseHeader(b)
+		kind, i, count := hdr.Kind, hdr.Index, hdr.Count
+		if !ok || (kind == SingleFrame || kind == StartFrame) && len(b) == h {
+			// too short to contain the sequence number
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrEmptyFrame)
+			continue
+		}
+		data := b[h:]
+		if kind == SingleFrame || kind == StartFrame {
+			sr.skipConts = false
+		}
+		switch {
+		case kind == SingleFrame:
+			if parts != nil {
+				s.recvError(ErrAbortedStart)
+			}
+			s.trace("->", "single", b)
+			s.startMsg()
+			dst = append(dst, data[1:]...)
+			s.releaseFrame(b)
+			if s.exceedsLimit(len(dst) - off) {
+				return dst[:off], s.rejectMsg(len(dst)-off, false)
+			}
+			s.countStat(&s.stats.MsgsReceived)
+			return s.checkMsg(dst, off)
+
+		case kind == StartFrame:
+			fseq := data[0]
+			data = data[1:]
+			if parts != nil && fseq == seq && len(parts) == count {
+				// the sender retransmits the whole message
+				break
+			}
+			if sr.delivered(fseq) {
+				// the final acknowledgement got lost
+				s.trace("->", "dup", b)
+				s.releaseFrame(b)
+				sr.skipConts = true
+				_, err = s.reportMissing(fseq, nil)
+				if err != nil {
+					return dst[:off], err
+				}
+				continue
+			}
+			if parts != nil {
+				s.recvError(ErrAbortedStart)
+			}
+			if s.exceedsLimit(count) {
+				s.trace("->", "??", b)
+				s.releaseFrame(b)
+				return dst[:off], s.rejectMsg(count, true)
+			}
+			parts = make([][]byte, count)
+			s.startMsg()
+			seq = fseq
+			nParts, size, nReports = 0, 0, 0
+			last = count - 1
+
+		case parts == nil && kind == ContFrame && sr.skipConts:
+			// remainder of a message delivered already, or rejected
+			s.trace("->", "skip", b)
+			s.releaseFrame(b)
+			continue
+
+		case parts == nil:
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrUnexpectedCont)
+			continue
+
+		case kind != ContFrame || i == 0 || i >= len(parts):
+			s.trace("->", "??", b)
+			s.releaseFrame(b)
+			s.recvError(ErrSeqGap)
+			continue
+		}
+
+		if parts[i] != nil {
+			// received already
+			s.trace("->", "dup", b)
+			s.releaseFrame(b)
+		} else {
+			if i == 0 {
+				s.trace("->", "start", b)
+			} else {
+				s.trace("->", "cont", b)
+			}
+			parts[i] = append(make([]byte, 0, len(data)), data...)
+			nParts++
+			size += len(data)
+			nReports = 0
+			s.releaseFrame(b)
+			if s.exceedsLimit(size) {
+				return dst[:off], s.rejectMsg(size, true)
+			}
+		}
+		if nParts == len(parts) {
+			_, err = s.reportMissing(seq, parts)
+			if err != nil {
+				return dst[:off], err
+			}
+			sr.rxSeq = seq
+			sr.deliveredAt = time.Now()
+			sr.skipConts = true
+			for _, p := range parts {
+				dst = append(dst, p...)
+			}
+			s.countStat(&s.stats.MsgsReceived)
+			return s.checkMsg(dst, off)
+		}
+		if i >= last {
+			// the current round is complete
+			last, err = s.reportMissing(seq, parts)
+			if err != nil {
+				return dst[:off], err
+			}
+		}
+	}
+}
+
+// reportMissing sends an acknowledgement for the message with sequence
+// number seq, listing as many indexes of missing parts as fit into
+// a frame, and returns the last index listed.
+func (s *Seg) reportMissing(seq byte, parts [][]byte) (last int, err error) {
+	hdr := Header{Kind: ControlFrame, Status: srAck}
+	h := s.codec.HeaderLen(hdr)
+	b := make([]byte, h+1, max(min(len(s.rBuf), srMaxAckLen), h+1))
+	s.codec.PutHeader(b, hdr)
+	b[h] = seq
+	for i, p := range parts {
+		if p != nil {
+			continue
+		}
+		hdr := Header{Kind: ContFrame, Index: i}
+		if i == 0 {
+			hdr = Header{Kind: StartFrame, Count: len(parts)}
+		}
+		n := len(b)
+		if n+s.codec.HeaderLen(hdr) > cap(b) {
+			break
+		}
+		b = b[:n+s.codec.PutHeader(b[n:cap(b)], hdr)]
+		last = i
+	}
+	s.trace("<-", "ack", b)
+	return last, s.writeFrame(b)
+}
+
+// dispatchAck checks whether frame b is an acknowledgement,
+// and if it is, passes it on to the writer.
+func (s *Seg) dispatchAck(b []byte) bool {
+	hdr, h, ok := s.codec.ParseHeader(b)
+	if !ok || hdr.Kind != ControlFrame || hdr.Status != srAck || len(b) < h+1 {
+		return false
+	}
+	s.trace("->", "ack", b)
+	a := srAckInfo{seq: b[h]}
+	p := b[h+1:]
+	for {
+		hdr, n, ok := s.codec.ParseHeader(p)
+		if !ok {
+			break
+		}
+		a.missing = append(a.missing, hdr.Index)
+		p = p[n:]
+	}
+	for {
+		select {
+		case s.sr.c <- a:
+			return true
+		default:
+			// replace an acknowledgement the writer has not consumed yet
+			s.discardAck()
+		}
+	}
+}
+
+// discardAck drops an acknowledgement that may
+// have been left over from a previous transfer.
+func (s *Seg) discardAck() {
+	select {
+	case <-s.sr.c:
+	default:
+	}
+}
+
+// confirm waits until the receiver acknowledges the message
+// whose frames have just been written, and retransmits frames
+// the receiver reports missing. Acknowledgements of other
+// messages are ignored.
+func (s *Seg) confirm(data []byte) error {
+	sr := s.sr
+	t := time.NewTimer(sr.Timeout)
+	defer t.Stop()
+
+	retry := 0
+	for {
+		var missing []int
+		select {
+		case a := <-sr.c:
+			if a.seq != sr.txSeq {
+				continue
+			}
+			if len(a.missing) == 0 {
+				return nil
+			}
+			if retry == sr.Retries {
+				return ErrRetransmitLimit
+			}
+			missing = a.missing
+		case <-t.C:
+			if retry == sr.Retries {
+				return ErrAckTimeout
+			}
+			missing = make([]int, len(sr.offs)-1)
+			for i := range missing {
+				missing[i] = i
+			}
+		}
+		err := s.retransmit(data, missing)
+		if err != nil {
+			return err
+		}
+		retry++
+		t.Reset(sr.Timeout)
+	}
+}
+
+// retransmit writes the frames with the specified indexes again.
+func (s *Seg) retransmit(data []byte, frames []int) error {
+	offs := s.sr.offs
+	n := len(offs) - 1
+	for k, i := range frames {
+		if i >= n {
+			continue
+		}
+		if d := s.WriteDelay(); k > 0 && d != 0 {
+			time.Sleep(d)
+		}
+		hdr := s.frameHeader(i, n, len(data))
+		h := s.codec.HeaderLen(hdr)
+		b := s.wBuf[:h+offs[i+1]-offs[i]]
+		s.codec.PutHeader(b, hdr)
+		copy(b[h:], data[offs[i]:offs[i+1]])
+		err := s.writeFrame(b)
+		s.trace("<-", "retx", b)
+		if err != nil {
+			return err
+		}
+		s.countStat(&s.stats.FramesSent)
+		s.countStat(&s.stats.Retransmits)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package slip transfers frames over byte streams, like TCP connections,
+// pipes, or serial lines, which do not preserve frame boundaries,
+// so that they can be used as transports of a seg.Seg.
+//
+// Frames are encoded according to SLIP (RFC 1055): each frame is
+// enclosed in END bytes, and END and ESC bytes within the frame
+// are replaced by two-byte escape sequences. Optionally,
+// a CRC-16 is appended to each frame.
+package slip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/knieriem/hash/crc16"
+	"github.com/knieriem/seg"
+)
+
+// Special characters as defined by RFC 1055.
+const (
+	end    = 0xC0
+	esc    = 0xDB
+	escEnd = 0xDC
+	escEsc = 0xDD
+)
+
+// Errors passed to the function registered using WithErrorFunc;
+// the affected frame is discarded.
+var (
+	ErrEscape = errors.New("slip: invalid escape sequence")
+	ErrCRC    = errors.New("slip: CRC mismatch")
+)
+
+// Conn is a frame transport over a byte stream.
+// It implements seg.FrameConn, and io.ReadWriter,
+// where each Read returns a single frame.
+type Conn struct {
+	rw      io.ReadWriter
+	r       *bufio.Reader
+	rBuf    []byte
+	crc     *crc16.Table
+	errFunc func(error)
+
+	wmu  sync.Mutex
+	wBuf []byte
+}
+
+// An Option configures a Conn.
+type Option func(*Conn)
+
+// WithCRC16 appends a CRC-16, as used by Modbus RTU, to each frame
+// written, and verifies and strips it from each frame read.
+// Both peers must use the same setting.
+func WithCRC16() Option {
+	tab := crc16.MakeTable(crc16.IBMCRC)
+	return func(c *Conn) {
+		c.crc = tab
+	}
+}
+
+// WithErrorFunc registers a function that is called for each
+// frame read that is discarded because it is corrupt.
+// It is called from within ReadFrame and should not block.
+func WithErrorFunc(f func(err error)) Option {
+	return func(c *Conn) {
+		c.errFunc = f
+	}
+}
+
+// New creates a Conn transferring frames over rw.
+func New(rw io.ReadWriter, opts ...Option) *Conn {
+	c := &Conn{
+		rw: rw,
+		r:  bufio.NewReader(rw),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Conn) crcLen() int {
+	if c.crc == nil {
+		return 0
+	}
+	return 2
+}
+
+// ReadFrame implements seg.FrameConn. Empty frames,
+// and frames that are corrupt, are skipped.
+func (c *Conn) ReadFrame(b []byte) (int, seg.FrameInfo, error) {
+	var info seg.FrameInfo
+	for {
+		frame, ok, err := c.readFrame(len(b) + c.crcLen())
+		if err != nil {
+			return 0, info, err
+		}
+		info.Time = time.Now()
+		switch {
+		case !ok:
+			// truncated frame; since it is incomplete,
+			// the CRC cannot be verified
+			return copy(b, frame), info, seg.ErrFrameTruncated
+		case len(frame) == 0:
+			continue
+		case c.crc != nil:
+			n := len(frame) - 2
+			if n < 0 || crc16.Checksum(frame[:n], c.crc) != uint16(frame[n])|uint16(frame[n+1])<<8 {
+				c.error(ErrCRC)
+				continue
+			}
+			frame = frame[:n]
+		}
+		return copy(b, frame), info, nil
+	}
+}
+
+// readFrame decodes the next frame, storing at most limit bytes.
+// If the frame is longer, ok is false. Frames containing invalid
+// escape sequences are skipped.
+func (c *Conn) readFrame(limit int) (frame []byte, ok bool, err error) {
+	frame = c.rBuf[:0]
+	ok = true
+	escaped := false
+	for {
+		var v byte
+		v, err = c.r.ReadByte()
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case v == end:
+			c.rBuf = frame
+			if escaped {
+				c.error(ErrEscape)
+				frame, ok, escaped = frame[:0], true, false
+				continue
+			}
+			return frame, ok, nil
+		case v == esc:
+			escaped = true
+			continue
+		case escaped:
+			escaped = false
+			switch v {
+			case escEnd:
+				v = end
+			case escEsc:
+				v = esc
+			default:
+				c.error(ErrEscape)
+				// skip the remainder of the frame
+				for v != end {
+					v, err = c.r.ReadByte()
+					if err != nil {
+						return nil, false, err
+					}
+				}
+				frame, ok = frame[:0], true
+				continue
+			}
+		}
+		if len(frame) == limit {
+			ok = false
+			continue
+		}
+		frame = append(frame, v)
+	}
+}
+
+func (c *Conn) error(err error) {
+	if c.errFunc != nil {
+		c.errFunc(err)
+	}
+}
+
+// WriteFrame implements seg.FrameConn. The encoded frame
+// is written to the underlying stream using a single Write.
+// It is preceded by an END byte, which terminates
+// any garbage the peer may have received before.
+func (c *Conn) WriteFrame(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	w := append(c.wBuf[:0], end)
+	w = appendEscaped(w, b)
+	if c.crc != nil {
+		sum := crc16.Checksum(b, c.crc)
+		w = appendEscaped(w, []byte{byte(sum), byte(sum >> 8)})
+	}
+	w = append(w, end)
+	c.wBuf = w
+	_, err := c.rw.Write(w)
+	return err
+}
+
+func appendEscaped(dst, b []byte) []byte {
+	for _, v := range b {
+		switch v {
+		case end:
+			dst = append(dst, esc, escEnd)
+		case esc:
+			dst = append(dst, esc, escEsc)
+		default:
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
+
+// Read reads a single frame, see ReadFrame.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrame(b)
+	return n, err
+}
+
+// Write writes b as a single frame, see WriteFrame.
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.WriteFrame(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,106 @@
+package slip_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/knieriem/seg"
+	"github.com/knieriem/seg/slip"
+)
+
+// testMsg returns a message containing all byte values,
+// including the special characters END and ESC.
+func testMsg(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*67 + 0xC0)
+	}
+	return b
+}
+
+func TestSeg_NetPipe(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		a, b := net.Pipe()
+		var opts []slip.Option
+		if crc {
+			opts = append(opts, slip.WithCRC16())
+		}
+		sender := seg.New(slip.New(a, opts...), 16, "sender")
+		receiver := seg.New(slip.New(b, opts...), 16, "receiver")
+
+		const maxLen = 300
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; n <= maxLen; n++ {
+				_, err := sender.Write(testMsg(n))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for n := 1; n <= maxLen; n++ {
+			msg, err := receiver.ReadMsg()
+			if err != nil {
+				t.Fatalf("crc %v, len %d: %v", crc, n, err)
+			}
+			if !bytes.Equal(msg, testMsg(n)) {
+				t.Fatalf("crc %v, len %d: got % x", crc, n, msg)
+			}
+		}
+		wg.Wait()
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestConn_IOPipe(t *testing.T) {
+	pr, pw := io.Pipe()
+	var errs []error
+	r := slip.New(struct {
+		io.Reader
+		io.Writer
+	}{pr, io.Discard}, slip.WithCRC16(), slip.WithErrorFunc(func(err error) {
+		errs = append(errs, err)
+	}))
+	w := slip.New(struct {
+		io.Reader
+		io.Writer
+	}{nil, pw}, slip.WithCRC16())
+
+	go func() {
+		var raw bytes.Buffer
+		raw.Write([]byte{0xC0, 'x', 'y', 'z', 0xC0})  // bad CRC
+		raw.Write([]byte{0xC0, 'x', 0xDB, 'y', 0xC0}) // bad escape sequence
+		raw.Write([]byte{0xC0, 0xC0, 0xC0})           // empty frames
+		pw.Write(raw.Bytes())
+		w.WriteFrame(testMsg(9)) // truncated
+		w.WriteFrame(testMsg(8))
+		pw.Close()
+	}()
+
+	b := make([]byte, 8)
+	n, _, err := r.ReadFrame(b)
+	if err != seg.ErrFrameTruncated || n != 8 {
+		t.Fatalf("got %d, %v; want 8, %v", n, err, seg.ErrFrameTruncated)
+	}
+	n, _, err = r.ReadFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], testMsg(8)) {
+		t.Errorf("got % x, want % x", b[:n], testMsg(8))
+	}
+	if len(errs) != 2 || errs[0] != slip.ErrCRC || errs[1] != slip.ErrEscape {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	_, _, err = r.ReadFrame(b)
+	if err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
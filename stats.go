@@ -0,0 +1,71 @@
+package seg
+
+import "errors"
+
+// Stats contains counters of frames and messages
+// transferred by a Seg, and of errors detected during reassembly.
+type Stats struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	MsgsSent       uint64
+	MsgsReceived   uint64
+
+	UnexpectedConts uint64 // see ErrUnexpectedCont
+	SeqGaps         uint64 // see ErrSeqGap
+	AbortedStarts   uint64 // see ErrAbortedStart
+	EmptyFrames     uint64 // see ErrEmptyFrame
+	TruncatedFrames uint64 // see ErrFrameTruncated
+	Timeouts        uint64 // inter-frame timeouts
+	ChecksumErrors  uint64 // see ChecksumError
+	OversizedMsgs   uint64 // see MsgSizeError
+	Duplicates      uint64 // frames ignored, see WithDuplicateTolerance
+	Retransmits     uint64 // frames sent again, see WithSelectiveRepeat
+	RejectedMsgs    uint64 // messages rejected, see SetLenCheck
+}
+
+// Stats returns a snapshot of the counters.
+func (s *Seg) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+func (s *Seg) countStat(p *uint64) {
+	s.statsMu.Lock()
+	*p++
+	s.statsMu.Unlock()
+}
+
+// recvError counts err in the statistics and
+// passes it to the error function, if set.
+func (s *Seg) recvError(err error) {
+	st := &s.stats
+	var p *uint64
+	var te *TimeoutError
+	var ce *ChecksumError
+	var me *MsgSizeError
+	switch {
+	case err == ErrUnexpectedCont:
+		p = &st.UnexpectedConts
+	case err == ErrSeqGap:
+		p = &st.SeqGaps
+	case err == ErrAbortedStart:
+		p = &st.AbortedStarts
+	case err == ErrEmptyFrame:
+		p = &st.EmptyFrames
+	case err == ErrFrameTruncated:
+		p = &st.TruncatedFrames
+	case errors.As(err, &te):
+		p = &st.Timeouts
+	case errors.As(err, &ce):
+		p = &st.ChecksumErrors
+	case errors.As(err, &me):
+		p = &st.OversizedMsgs
+	}
+	if p != nil {
+		s.countStat(p)
+	}
+	if s.errFunc != nil {
+		s.errFunc(err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package vcan implements a virtual CAN bus within the process, so that
+// CAN based transports, like the seg/can protocol, can be tested
+// without adapter hardware.
+//
+// Devices are opened using Open, with a specification like
+//
+//	<bus>[,fd][,f<id>]...
+//
+// All devices opened with the same bus name are nodes of the same bus;
+// a message written by one node is received by all other nodes. Option
+// fd allows a node to write CAN FD frames of up to 64 bytes. Each
+// f<id> option adds an acceptance filter for the hexadecimal identifier;
+// identifiers longer than three digits denote extended frames.
+// A node without filters receives all messages. Other options,
+// like bit rates, are ignored.
+package vcan
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knieriem/can"
+)
+
+// QueueLen is the number of messages a node is able to buffer;
+// further messages are dropped, as on a controller overrun.
+const QueueLen = 256
+
+var (
+	ErrClosed      = errors.New("vcan: device closed")
+	ErrInvalidData = errors.New("vcan: invalid data length")
+)
+
+var (
+	busesMu sync.Mutex
+	buses   = make(map[string]*Bus)
+)
+
+// Open attaches a new node to the bus named in devSpec,
+// see the package documentation.
+func Open(devSpec string) (*Node, error) {
+	name, opts, _ := strings.Cut(devSpec, ",")
+	var list []string
+	if opts != "" {
+		list = strings.Split(opts, ",")
+	}
+	return GetBus(name).Open(list...)
+}
+
+// Bus is a virtual CAN bus.
+type Bus struct {
+	name  string
+	mu    sync.Mutex
+	nodes []*Node
+}
+
+// GetBus returns the bus with the specified name, creating it if necessary.
+func GetBus(name string) *Bus {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	b := buses[name]
+	if b == nil {
+		b = &Bus{name: name}
+		buses[name] = b
+	}
+	return b
+}
+
+// Open attaches a new node to the bus; opts are the options
+// of a device specification, see the package documentation.
+func (b *Bus) Open(opts ...string) (*Node, error) {
+	n := &Node{
+		bus:  b,
+		rx:   make(chan can.Msg, QueueLen),
+		done: make(chan struct{}),
+	}
+	for _, o := range opts {
+		switch {
+		case o == "fd":
+			n.fd = true
+		case strings.HasPrefix(o, "f"):
+			f, err := parseFilter(o[1:])
+			if err != nil {
+				return nil, err
+			}
+			n.filters = append(n.filters, f)
+		}
+	}
+	b.mu.Lock()
+	b.nodes = append(b.nodes, n)
+	b.mu.Unlock()
+	return n, nil
+}
+
+// Inject delivers m to all nodes of the bus, regardless of their
+// acceptance filters, like a status message reported by the controllers.
+func (b *Bus) Inject(m can.Msg) {
+	b.send(nil, m)
+}
+
+// Nodes returns the number of nodes attached to the bus.
+func (b *Bus) Nodes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.nodes)
+}
+
+// send delivers m to all nodes except the sender
+// whose acceptance filters match. Messages without
+// a sender, see Inject, are delivered to all nodes.
+func (b *Bus) send(sender *Node, m can.Msg) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, n := range b.nodes {
+		if n == sender || sender != nil && !n.accepts(&m) {
+			continue
+		}
+		select {
+		case n.rx <- m:
+		default:
+			// overrun
+		}
+	}
+}
+
+func (b *Bus) remove(n *Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nodes = slices.DeleteFunc(b.nodes, func(n1 *Node) bool { return n1 == n })
+}
+
+type filter struct {
+	id  uint32
+	ext bool
+}
+
+func parseFilter(s string) (filter, error) {
+	u, err := strconv.ParseUint(s, 16, 29)
+	if err != nil {
+		return filter{}, err
+	}
+	return filter{id: uint32(u), ext: len(s) > 3}, nil
+}
+
+// Node is a device attached to a Bus. It implements can.Device.
+type Node struct {
+	bus     *Bus
+	fd      bool
+	filters []filter
+	rx      chan can.Msg
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (n *Node) accepts(m *can.Msg) bool {
+	if len(n.filters) == 0 {
+		return true
+	}
+	for _, f := range n.filters {
+		if f.id == m.Id && f.ext == m.ExtFrame() {
+			return true
+		}
+	}
+	return false
+}
+
+// Read waits for at least one message, and stores
+// as many messages as are available into buf.
+func (n *Node) Read(buf []can.Msg) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	select {
+	case buf[0] = <-n.rx:
+	case <-n.done:
+		return 0, ErrClosed
+	}
+	i := 1
+	for ; i < len(buf); i++ {
+		select {
+		case buf[i] = <-n.rx:
+		default:
+			return i, nil
+		}
+	}
+	return i, nil
+}
+
+// WriteMsg sends a copy of m to the other nodes of the bus. Messages
+// with more than eight bytes of data are accepted if the node has been
+// opened with option fd, and if the length is a valid CAN FD size.
+func (n *Node) WriteMsg(m *can.Msg) error {
+	select {
+	case <-n.done:
+		return ErrClosed
+	default:
+	}
+	data := m.Data()
+	if len(data) > 8 && (!n.fd || !slices.Contains(can.ValidFDSizes, len(data))) {
+		return ErrInvalidData
+	}
+	m1 := *m
+	d := can.PlainData(slices.Clone(data))
+	m1.Attach(&d)
+	n.bus.send(n, m1)
+	return nil
+}
+
+// Close detaches the node from the bus.
+// Reads waiting for messages return ErrClosed.
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		n.bus.remove(n)
+		close(n.done)
+	})
+	return nil
+}
+
+// Info returns an empty can.Info; a virtual node
+// has no driver or hardware information.
+func (n *Node) Info() can.Info {
+	var info can.Info
+	return info
+}
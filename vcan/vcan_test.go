@@ -0,0 +1,134 @@
+package vcan_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/knieriem/can"
+	"github.com/knieriem/seg/vcan"
+)
+
+func msg(id uint32, ext bool, data ...byte) *can.Msg {
+	m := &can.Msg{Id: id}
+	if ext {
+		m.Flags |= can.ExtFrame
+	}
+	d := can.PlainData(data)
+	m.Attach(&d)
+	return m
+}
+
+func open(t *testing.T, spec string) *vcan.Node {
+	t.Helper()
+	dev, err := vcan.Open(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+func TestFilters(t *testing.T) {
+	a := open(t, "filters,500k")
+	b := open(t, "filters,f123,f18fa1900")
+	c := open(t, "filters,f124")
+
+	for _, m := range []*can.Msg{
+		msg(0x123, false, 1),
+		msg(0x124, false, 2),
+		msg(0x123, true, 3),
+		msg(0x18FA1900, true, 4),
+	} {
+		if err := a.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]can.Msg, 8)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || buf[0].Data()[0] != 1 || buf[1].Data()[0] != 4 {
+		t.Errorf("b: unexpected messages: %v", buf[:n])
+	}
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || buf[0].Data()[0] != 2 {
+		t.Errorf("c: unexpected messages: %v", buf[:n])
+	}
+
+	// a receives messages from b and c, but not its own
+	b.WriteMsg(msg(0x321, false, 5))
+	n, err = a.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || buf[0].Data()[0] != 5 {
+		t.Errorf("a: unexpected messages: %v", buf[:n])
+	}
+}
+
+func TestFD(t *testing.T) {
+	classic := open(t, "fd")
+	fd := open(t, "fd,fd")
+
+	data := bytes.Repeat([]byte{0x55}, 12)
+	if err := classic.WriteMsg(msg(1, false, data...)); err != vcan.ErrInvalidData {
+		t.Errorf("classic: got %v, want %v", err, vcan.ErrInvalidData)
+	}
+	if err := fd.WriteMsg(msg(1, false, data[:10]...)); err != vcan.ErrInvalidData {
+		t.Errorf("fd, 10 bytes: got %v, want %v", err, vcan.ErrInvalidData)
+	}
+	if err := fd.WriteMsg(msg(1, false, data...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]can.Msg, 1)
+	n, err := classic.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !bytes.Equal(buf[0].Data(), data) {
+		t.Errorf("unexpected messages: %v", buf[:n])
+	}
+}
+
+func TestStatus(t *testing.T) {
+	dev := open(t, "status,f100")
+	vcan.GetBus("status").Inject(can.Msg{Flags: can.StatusMsg | can.BusOff})
+
+	buf := make([]can.Msg, 1)
+	n, err := dev.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !buf[0].IsStatus() || !buf[0].Test(can.BusOff) {
+		t.Errorf("unexpected messages: %v", buf[:n])
+	}
+}
+
+func TestClose(t *testing.T) {
+	dev := open(t, "close")
+	bus := vcan.GetBus("close")
+	if n := bus.Nodes(); n != 1 {
+		t.Fatalf("got %d nodes, want 1", n)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := dev.Read(make([]can.Msg, 1))
+		done <- err
+	}()
+	dev.Close()
+	if err := <-done; err != vcan.ErrClosed {
+		t.Errorf("Read: got %v, want %v", err, vcan.ErrClosed)
+	}
+	if err := dev.WriteMsg(msg(1, false)); err != vcan.ErrClosed {
+		t.Errorf("WriteMsg: got %v, want %v", err, vcan.ErrClosed)
+	}
+	if n := bus.Nodes(); n != 0 {
+		t.Errorf("got %d nodes, want 0", n)
+	}
+}